@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+)
+
+const (
+	//gcsComposeLimit is the largest number of source objects which GCS composes in a single request
+	gcsComposeLimit = 32
+	//s3ComposeLimit is the largest number of parts in an S3 multipart upload
+	s3ComposeLimit = 10000
+)
+
+// ComposeOptions controls a compose
+type ComposeOptions struct {
+	//ContentType is the content type of the composed object
+	ContentType string
+	//Metadata holds custom metadata to store with the composed object
+	Metadata map[string]string
+	//DeleteSources deletes the source objects once they have been composed. A source is only deleted if it has not
+	//changed since the compose started
+	DeleteSources bool
+}
+
+// composer is implemented by the backends to compose objects
+type composer interface {
+	Stat(ctx context.Context, bucketName string, fileName string) (*ObjectInfo, error)
+	RemoveFile(ctx context.Context, bucketName string, fileName string) error
+	//composeOnce concatenates up to the backend limit of source objects into the destination
+	composeOnce(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error)
+	//removeVersion deletes an object if it is unchanged from info
+	removeVersion(ctx context.Context, bucketName, fileName string, info *ObjectInfo) error
+}
+
+// composeWriteOptions returns the options for writing a composed object
+func composeWriteOptions(opts *ComposeOptions) *WriteOptions {
+	if opts == nil {
+		return nil
+	}
+
+	return &WriteOptions{ContentType: opts.ContentType, Metadata: opts.Metadata}
+}
+
+// composeObjects concatenates the source objects into the destination, in order. If there are more sources than the
+// backend can compose at once, groups of them are first composed into temporary objects named after the destination,
+// which are deleted afterwards. If the destination was written but the temporary objects or sources could not all be
+// deleted, its attributes are returned along with the error
+func composeObjects(ctx context.Context, c composer, limit int, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	if len(srcNames) == 0 {
+		return nil, ErrMissingSources
+	}
+
+	//sources are only deleted if they still hold the data which was composed
+	var srcs []*ObjectInfo
+	if opts != nil && opts.DeleteSources {
+		for _, name := range srcNames {
+			info, err := c.Stat(ctx, bucketName, name)
+			if err != nil {
+				return nil, err
+			}
+			srcs = append(srcs, info)
+		}
+	}
+
+	var temps []string
+
+	//the temporary objects are removed even if the compose fails, or the context is cancelled
+	cleanup := func() error {
+		var errs []error
+		for _, name := range temps {
+			if err := c.RemoveFile(context.WithoutCancel(ctx), bucketName, name); err != nil && !errors.Is(err, ErrNotFound) {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	prefix := fmt.Sprintf("%s.compose-%016x", dstName, rand.Uint64())
+
+	names := srcNames
+	for round := 0; len(names) > limit; round++ {
+		var next []string
+
+		for i := 0; i < len(names); i += limit {
+			group := names[i:min(i+limit, len(names))]
+			if len(group) == 1 {
+				next = append(next, group[0])
+				continue
+			}
+
+			tmp := fmt.Sprintf("%s-%d-%d", prefix, round, i/limit)
+			temps = append(temps, tmp)
+
+			if _, err := c.composeOnce(ctx, bucketName, tmp, group, nil); err != nil {
+				return nil, errors.Join(err, cleanup())
+			}
+
+			next = append(next, tmp)
+		}
+
+		names = next
+	}
+
+	info, err := c.composeOnce(ctx, bucketName, dstName, names, opts)
+	if err != nil {
+		return nil, errors.Join(err, cleanup())
+	}
+
+	errs := []error{cleanup()}
+
+	//a source may be listed more than once, and the destination may replace one of the sources
+	done := map[string]bool{dstName: true}
+	for _, src := range srcs {
+		if done[src.Name] {
+			continue
+		}
+		done[src.Name] = true
+
+		if err := c.removeVersion(ctx, bucketName, src.Name, src); err != nil {
+			errs = append(errs, fmt.Errorf("deleting %s: %w", src.Name, err))
+		}
+	}
+
+	return info, errors.Join(errs...)
+}
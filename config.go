@@ -10,51 +10,67 @@ import (
 )
 
 var (
-	//EnvDebugOn controls verbose logging
+	// EnvDebugOn held the verbose logging setting loaded by NewMgr or NewJSONMgr. It is no longer set, so that
+	// managers can be created concurrently.
+	//
+	// Deprecated: each StorMgr holds its own setting, see StorMgr.DebugOn
 	EnvDebugOn bool
-	//EnvClientPool is the size of the client pool
+	// EnvClientPool held the client pool size loaded by NewMgr or NewJSONMgr. It is no longer set, so that managers
+	// can be created concurrently.
+	//
+	// Deprecated: each StorMgr holds its own setting, see StorMgr.PoolSize
 	EnvClientPool int
 )
 
-//preflight config checks
-func preflight(ctx context.Context, bc lbcf.ConfigSetting) {
+// preflight config checks, returning the config for a new manager
+func preflight(ctx context.Context, bc lbcf.ConfigSetting) *mgrConfig {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.LUTC)
 	log.Println("Started Storage preflight..")
 
+	debugOn, poolSize, err := loadEnvConfig(ctx, bc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("..Finished Storage preflight.")
+
+	return &mgrConfig{
+		bc:       bc,
+		debugOn:  debugOn,
+		poolSize: poolSize,
+	}
+}
+
+// loadEnvConfig loads the environment config vars into the config, and returns the debug and pool size settings
+func loadEnvConfig(ctx context.Context, bc lbcf.ConfigSetting) (bool, int, error) {
 	//get the session config and apply it to the config
 	bc.LoadConfigMap(ctx, preflightConfigLoader())
 
 	//then check that we have everything we need
 	if bc.GetConfigValue(ctx, "EnvDebugOn") == "" {
-		log.Fatal("Could not parse environment variable EnvDebugOn")
+		return false, 0, ErrInvalidDebugOn
 	}
 
 	if bc.GetConfigValue(ctx, "EnvStorClientPool") == "" {
-		log.Fatal("Could not parse environment variable EnvStorClientPool")
+		return false, 0, ErrInvalidClientPool
 	}
 
 	//set the debug value
-	constlog, err := strconv.ParseBool(bc.GetConfigValue(ctx, "EnvDebugOn"))
-
+	debugOn, err := strconv.ParseBool(bc.GetConfigValue(ctx, "EnvDebugOn"))
 	if err != nil {
-		log.Fatal("Could not parse environment variable EnvDebugOn")
+		return false, 0, ErrInvalidDebugOn
 	}
 
-	EnvDebugOn = constlog
-
 	//set the poolsize
 	pl, err := strconv.ParseInt(bc.GetConfigValue(ctx, "EnvStorClientPool"), 10, 64)
-
-	if err != nil {
-		log.Fatal("Could not parse environment variable EnvStorClientPool")
+	if err != nil || pl < 1 {
+		return false, 0, ErrInvalidClientPool
 	}
 
-	EnvClientPool = int(pl)
-
-	log.Println("..Finished Storage preflight.")
+	return debugOn, int(pl), nil
 }
 
-//preflightConfigLoader loads the config vars
+// preflightConfigLoader loads the config vars
 func preflightConfigLoader() map[string]string {
 	cfm := make(map[string]string)
 
@@ -63,13 +79,5 @@ func preflightConfigLoader() map[string]string {
 	//EnvStorClientPool is the client poolsize
 	cfm["EnvStorClientPool"] = os.Getenv("STOR_CLIPOOL")
 
-	if cfm["EnvDebugOn"] == "" {
-		log.Fatal("Could not parse environment variable EnvDebugOn")
-	}
-
-	if cfm["EnvStorClientPool"] == "" {
-		log.Fatal("Could not parse environment variable EnvStorClientPool")
-	}
-
 	return cfm
 }
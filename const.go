@@ -14,3 +14,8 @@ const (
 	//ObjAttrCreated created timestamp
 	ObjAttrCreated = "created"
 )
+
+const (
+	//gcsAPIPath is the GCS JSON API path, relative to the service endpoint
+	gcsAPIPath = "/storage/v1"
+)
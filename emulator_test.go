@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	lbcf "github.com/lidstromberg/config"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// newEmulatorMgr returns a storage manager connected to a fresh GCS emulator holding an empty bucket
+func newEmulatorMgr(t *testing.T, bucketName string) (*gcsFake, *StorMgr) {
+	t.Helper()
+
+	t.Setenv("STOR_DEBUGON", "false")
+	t.Setenv("STOR_CLIPOOL", "1")
+
+	fk, endpoint := newGCSFake(t, bucketName)
+
+	ctx := context.Background()
+
+	//create a new config object
+	bc := lbcf.NewConfig(ctx)
+
+	//create a new storage object pointing at the emulator
+	sto, err := NewMgr(ctx, bc, EmulatorOptions(endpoint)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fk, sto
+}
+
+func Test_EmulatorEndpointForms(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("STOR_DEBUGON", "false")
+	t.Setenv("STOR_CLIPOOL", "1")
+
+	_, endpoint := newGCSFake(t, "gcsbucket")
+
+	//each form of the endpoint should resolve onto the JSON API path
+	for _, ep := range []string{endpoint, endpoint + "/", endpoint + "/storage/v1", endpoint + "/storage/v1/"} {
+		sto, err := NewMgr(ctx, lbcf.NewConfig(ctx), EmulatorOptions(ep)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := sto.WriteBucketFile(ctx, "gcsbucket", testFile, []byte("{}")); err != nil {
+			t.Fatalf("write via %s: %v", ep, err)
+		}
+	}
+}
+
+func Test_EmulatorWriteReadRemove(t *testing.T) {
+	ctx := context.Background()
+
+	_, sto := newEmulatorMgr(t, "gcsbucket")
+
+	//read in the file data
+	dat, err := getLocalFileData(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "tests/" + testFile
+
+	//write to the test bucket
+	err = sto.WriteBucketFile(ctx, "gcsbucket", name, dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//read the data back from the bucket
+	got, err := sto.GetBucketFileData(ctx, "gcsbucket", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(dat) {
+		t.Fatalf("read %q, want %q", got, dat)
+	}
+
+	//remove the file, then check that it has gone
+	err = sto.RemoveFile(ctx, "gcsbucket", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sto.GetBucketFileData(ctx, "gcsbucket", name)
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("read after remove returned %v, want ErrObjectNotExist", err)
+	}
+}
+
+func Test_EmulatorListBucket(t *testing.T) {
+	ctx := context.Background()
+
+	_, sto := newEmulatorMgr(t, "gcsbucket")
+
+	for _, name := range []string{"b/2.json", "a/1.json", "b/1.json", "c.json"} {
+		if err := sto.WriteBucketFile(ctx, "gcsbucket", name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rfchn, err := sto.ListBucket(ctx, "gcsbucket", "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 4 || names[0] != "a/1.json" {
+		t.Fatalf("unexpected listing %v", names)
+	}
+
+	rfchn, err = sto.ListBucket(ctx, "gcsbucket", "b/", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 2 {
+		t.Fatalf("unexpected prefix listing %v", names)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+
+	rfchn, err = sto.ListBucketByTime(ctx, "gcsbucket", "", &start, &end, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 4 {
+		t.Fatalf("unexpected listing %v", names)
+	}
+}
+
+func Test_EmulatorListErrorCancel(t *testing.T) {
+	_, sto := newEmulatorMgr(t, "gcsbucket")
+
+	//open a connection to the emulator before counting goroutines
+	if err := sto.WriteBucketFile(context.Background(), "gcsbucket", "warm.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+
+	//the listing error waits on an unbuffered channel which is never read
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if _, err := sto.ListBucket(ctx, "nobucket", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	waitGoroutines(t, before)
+}
+
+func Test_EmulatorListOffsets(t *testing.T) {
+	fk, sto := newEmulatorMgr(t, "gcsbucket")
+
+	//name offsets are sent to GCS rather than applied to the full listing
+	it := sto.QueryObjects(context.Background(), "gcsbucket", &ListQuery{StartOffset: "q/2", EndOffset: "q/3"})
+	for it.Next() {
+	}
+
+	fk.mu.Lock()
+	q := fk.lastList
+	fk.mu.Unlock()
+
+	if q.Get("startOffset") != "q/2" || q.Get("endOffset") != "q/3" {
+		t.Fatalf("listing request did not carry the offsets: %v", q)
+	}
+}
+
+func Test_EmulatorListGlob(t *testing.T) {
+	fk, sto := newEmulatorMgr(t, "gcsbucket")
+
+	//the glob is sent to GCS
+	it := sto.QueryObjects(context.Background(), "gcsbucket", &ListQuery{MatchGlob: "reports/2024-*/summary.json"})
+	for it.Next() {
+	}
+
+	fk.mu.Lock()
+	q := fk.lastList
+	fk.mu.Unlock()
+
+	if q.Get("matchGlob") != "reports/2024-*/summary.json" {
+		t.Fatalf("listing request did not carry the glob: %v", q)
+	}
+
+	for _, name := range []string{"a.json", "a/b.json", "b.txt"} {
+		if err := sto.WriteBucketFile(context.Background(), "gcsbucket", name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the names GCS matches are returned as they are, even where the local glob would not match them
+	fk.mu.Lock()
+	fk.glob = func(string) (func(string) bool, error) {
+		return func(name string) bool { return strings.HasSuffix(name, ".json") }, nil
+	}
+	fk.mu.Unlock()
+
+	objs := collectObjects(t, mustList(t, sto, "gcsbucket", &ListQuery{MatchGlob: "*.json"}))
+	if len(objs) != 2 || objs[0].Name != "a.json" || objs[1].Name != "a/b.json" {
+		t.Fatalf("glob listing returned %v, want the names matched by GCS", objs)
+	}
+
+	//an invalid glob is still reported
+	it = sto.QueryObjects(context.Background(), "gcsbucket", &ListQuery{MatchGlob: "[abc"})
+	for it.Next() {
+	}
+
+	if !errors.Is(it.Err(), ErrInvalidGlob) {
+		t.Fatalf("invalid glob returned %v, want ErrInvalidGlob", it.Err())
+	}
+}
+
+func Test_EmulatorCopyRewrites(t *testing.T) {
+	fk, sto := newEmulatorMgr(t, "gcsbucket")
+
+	fk.mu.Lock()
+	fk.buckets["gcsother"] = map[string]*gcsFakeObject{}
+	fk.mu.Unlock()
+
+	//large objects take several rewrite calls
+	fk.mu.Lock()
+	fk.rewriteChunk = 1 << 10
+	fk.rewrites = 0
+	fk.mu.Unlock()
+
+	dat := bytes.Repeat([]byte("0123456789"), 1000)
+	if _, err := sto.WriteBucketFileData(context.Background(), "gcsbucket", "copy/big.bin", dat); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sto.Copy(context.Background(), "gcsbucket", "copy/big.bin", "gcsother", "copy/big.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	fk.mu.Lock()
+	rewrites := fk.rewrites
+	fk.mu.Unlock()
+
+	if rewrites != 10 {
+		t.Fatalf("copy took %d rewrite calls, want 10", rewrites)
+	}
+
+	if got, err := sto.GetBucketFileData(context.Background(), "gcsother", "copy/big.bin"); err != nil || !bytes.Equal(got, dat) {
+		t.Fatalf("copy of large object is %d bytes, %v, want %d bytes", len(got), err, len(dat))
+	}
+}
+
+func Test_EmulatorComposeRounds(t *testing.T) {
+	ctx := context.Background()
+
+	fk, sto := newEmulatorMgr(t, "gcsbucket")
+
+	var names []string
+	for i := range 70 {
+		name := fmt.Sprintf("compose/part-%03d", i)
+		if err := sto.WriteBucketFile(ctx, "gcsbucket", name, []byte{'x'}); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	composes := func() int {
+		fk.mu.Lock()
+		defer fk.mu.Unlock()
+		return fk.composes
+	}
+
+	//seventy sources take three intermediate composes and a final one
+	if _, err := sto.Compose(ctx, "gcsbucket", "compose/all", names, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := composes(); n != 4 {
+		t.Fatalf("compose made %d compose calls, want 4", n)
+	}
+
+	//sixty eight sources get through two intermediate composes before the third finds the missing source
+	if _, err := sto.Compose(ctx, "gcsbucket", "compose/missing", append(names[3:], "compose/missing"), nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("compose with missing source returned %v, want ErrNotFound", err)
+	}
+
+	if n := composes(); n != 4+2 {
+		t.Fatalf("composes made %d compose calls, want %d", n, 4+2)
+	}
+}
+
+func Test_EmulatorErrors(t *testing.T) {
+	fk, sto := newEmulatorMgr(t, "gcsbucket")
+
+	ctx := context.Background()
+
+	tests := []struct {
+		status int
+		reason string
+		want   error
+	}{
+		{http.StatusForbidden, "forbidden", ErrPermissionDenied},
+		{http.StatusForbidden, "rateLimitExceeded", ErrQuotaExceeded},
+		{http.StatusConflict, "conflict", ErrAlreadyExists},
+		{http.StatusPreconditionFailed, "conditionNotMet", ErrPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		fk.mu.Lock()
+		fk.failStatus, fk.failReason = tt.status, tt.reason
+		fk.mu.Unlock()
+
+		_, err := sto.Stat(ctx, "gcsbucket", "errors/obj.txt")
+		if !errors.Is(err, tt.want) {
+			t.Fatalf("stat failing with %d %s returned %v, want %v", tt.status, tt.reason, err, tt.want)
+		}
+
+		var gerr *googleapi.Error
+		if !errors.As(err, &gerr) || gerr.Code != tt.status {
+			t.Fatalf("stat failing with %d %s returned %v, want a googleapi.Error", tt.status, tt.reason, err)
+		}
+
+		err = sto.RemoveFile(ctx, "gcsbucket", "errors/obj.txt")
+		if !errors.Is(err, tt.want) {
+			t.Fatalf("remove failing with %d %s returned %v, want %v", tt.status, tt.reason, err, tt.want)
+		}
+
+		it := sto.Objects(ctx, "gcsbucket", "errors/")
+		for it.Next() {
+		}
+
+		if !errors.Is(it.Err(), tt.want) {
+			t.Fatalf("listing failing with %d %s returned %v, want %v", tt.status, tt.reason, it.Err(), tt.want)
+		}
+	}
+}
+
+func Test_EmulatorWriteBucketFileCommit(t *testing.T) {
+	ctx := context.Background()
+
+	_, sto := newEmulatorMgr(t, "gcsbucket")
+
+	//the upload is committed on close, so a failed commit must be reported
+	if err := sto.WriteBucketFile(ctx, "nobucket", testFile, []byte("{}")); err == nil {
+		t.Fatal("write to missing bucket succeeded")
+	}
+
+	info, err := sto.WriteBucketFileData(ctx, "gcsbucket", testFile, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Bucket != "gcsbucket" || info.Name != testFile || info.Size != 2 || info.Generation == 0 || len(info.MD5) == 0 || info.CRC32C == 0 {
+		t.Fatalf("unexpected attributes %+v", info)
+	}
+}
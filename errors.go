@@ -1,8 +1,155 @@
 package storage
 
-import "errors"
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"syscall"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
 
 var (
+	//ErrNotFound message
+	ErrNotFound = errors.New("object or bucket not found")
+	//ErrAlreadyExists message
+	ErrAlreadyExists = errors.New("object or bucket already exists")
+	//ErrPreconditionFailed message
+	ErrPreconditionFailed = errors.New("precondition failed")
+	//ErrPermissionDenied message
+	ErrPermissionDenied = errors.New("permission denied")
+	//ErrQuotaExceeded message
+	ErrQuotaExceeded = errors.New("quota or rate limit exceeded")
+
 	//ErrMissingDateRange  message
 	ErrMissingDateRange = errors.New("start and end dates must be supplied")
+	//ErrInvalidBucketName message
+	ErrInvalidBucketName = errors.New("bucket name is not valid")
+	//ErrInvalidObjectName message
+	ErrInvalidObjectName = errors.New("object name is not valid")
+	//ErrMissingEndpoint message
+	ErrMissingEndpoint = errors.New("endpoint must be supplied")
+	//ErrInvalidRange message
+	ErrInvalidRange = errors.New("requested range is not satisfiable")
+	//ErrInvalidPageToken message
+	ErrInvalidPageToken = errors.New("listing page token is not valid")
+	//ErrInvalidGlob message
+	ErrInvalidGlob = errors.New("listing glob pattern is not valid")
+	//ErrInvalidConditions message
+	ErrInvalidConditions = errors.New("does not exist cannot be combined with other conditions or used for deletes")
+	//ErrUnsupportedCondition message
+	ErrUnsupportedCondition = errors.New("condition is not supported by this backend")
+	//ErrMissingSources message
+	ErrMissingSources = errors.New("at least one source object must be supplied")
+	//ErrMissingObjects message
+	ErrMissingObjects = errors.New("object names or a prefix must be supplied")
+	//ErrInvalidDebugOn message
+	ErrInvalidDebugOn = errors.New("could not parse environment variable EnvDebugOn")
+	//ErrInvalidClientPool message
+	ErrInvalidClientPool = errors.New("could not parse environment variable EnvStorClientPool")
+	//ErrInvalidPoolSize message
+	ErrInvalidPoolSize = errors.New("client pool size must be at least 1")
 )
+
+// Error is a backend error which has been classified as one of ErrNotFound, ErrAlreadyExists, ErrPreconditionFailed,
+// ErrPermissionDenied or ErrQuotaExceeded. errors.Is matches both that error and the backend error, such as
+// storage.ErrObjectNotExist, and errors.As reaches backend error types such as *googleapi.Error and *S3Error
+type Error struct {
+	//Kind is the package error which the backend error was classified as
+	Kind error
+	//Err is the backend error
+	Err error
+}
+
+// Error returns the backend error message
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the package error and the backend error
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// classify wraps a backend error in an *Error if it matches one of the package errors, and returns any other error
+// unchanged
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var se *Error
+	if errors.As(err, &se) {
+		return err
+	}
+
+	if kind := errorKind(err); kind != nil {
+		return &Error{Kind: kind, Err: err}
+	}
+
+	return err
+}
+
+// errorKind returns the package error matching a backend error, or nil if there is none
+func errorKind(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist), errors.Is(err, fs.ErrNotExist):
+		return ErrNotFound
+	case errors.Is(err, fs.ErrExist):
+		return ErrAlreadyExists
+	case errors.Is(err, fs.ErrPermission):
+		return ErrPermissionDenied
+	case errors.Is(err, syscall.ENOSPC):
+		return ErrQuotaExceeded
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		//GCS reports rate and quota limits as forbidden as well as too many requests
+		for _, item := range gerr.Errors {
+			switch item.Reason {
+			case "quotaExceeded", "rateLimitExceeded", "userRateLimitExceeded", "dailyLimitExceeded":
+				return ErrQuotaExceeded
+			}
+		}
+
+		switch gerr.Code {
+		case http.StatusNotFound:
+			return ErrNotFound
+		case http.StatusConflict:
+			return ErrAlreadyExists
+		case http.StatusPreconditionFailed, http.StatusNotModified:
+			return ErrPreconditionFailed
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ErrPermissionDenied
+		case http.StatusTooManyRequests:
+			return ErrQuotaExceeded
+		}
+	}
+
+	var serr *S3Error
+	if errors.As(err, &serr) {
+		switch serr.Code {
+		case "BucketAlreadyExists", "BucketAlreadyOwnedByYou":
+			return ErrAlreadyExists
+		case "ConditionalRequestConflict":
+			return ErrPreconditionFailed
+		case "SlowDown", "TooManyRequests", "ServiceQuotaExceeded":
+			return ErrQuotaExceeded
+		}
+
+		switch serr.StatusCode {
+		case http.StatusNotFound:
+			return ErrNotFound
+		case http.StatusPreconditionFailed, http.StatusNotModified:
+			return ErrPreconditionFailed
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return ErrPermissionDenied
+		case http.StatusTooManyRequests:
+			return ErrQuotaExceeded
+		}
+	}
+
+	return nil
+}
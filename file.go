@@ -0,0 +1,900 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	//fileMetaDir holds the sidecar metadata tree beneath the FileMgr root
+	fileMetaDir = ".meta"
+	//fileTempDir holds partially written objects beneath the FileMgr root
+	fileTempDir = ".tmp"
+	//fileMetaExt is the extension given to sidecar metadata files
+	fileMetaExt = ".json"
+	//fileMetaDirExt is the extension given to the directories of the sidecar metadata tree
+	fileMetaDirExt = ".d"
+)
+
+// FileMgr is a local filesystem implementation of ObjectStore. Each bucket is a directory beneath the root,
+// each object is a file within its bucket, and object metadata is kept in a sidecar file under root/.meta
+type FileMgr struct {
+	root string
+	mu   sync.RWMutex
+}
+
+// fileMeta is the sidecar metadata stored for each object
+type fileMeta struct {
+	ContentType     string            `json:"contentType"`
+	ContentEncoding string            `json:"contentEncoding"`
+	Created         time.Time         `json:"created"`
+	Updated         time.Time         `json:"updated"`
+	Generation      int64             `json:"generation"`
+	Metageneration  int64             `json:"metageneration"`
+	MD5             []byte            `json:"md5,omitempty"`
+	CRC32C          uint32            `json:"crc32c"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// NewFileMgr returns a new filesystem storage manager rooted at dir, creating it if required
+func NewFileMgr(dir string) (*FileMgr, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range []string{root, filepath.Join(root, fileMetaDir), filepath.Join(root, fileTempDir)} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileMgr{root: root}, nil
+}
+
+// GetBucketFileData returns a byte array for a bucket file
+func (fm *FileMgr) GetBucketFileData(ctx context.Context, bucketName string, fileName string) ([]byte, error) {
+	rc, err := fm.GetBucketFileReader(ctx, bucketName, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// GetBucketFileReader returns a reader for a bucket file, which the caller must close. Reads fail once the context is done
+func (fm *FileMgr) GetBucketFileReader(ctx context.Context, bucketName string, fileName string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dataPath, _, err := fm.paths(bucketName, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	//objects are replaced by rename, so an open file is unaffected by later writes
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	f, _, err := openData(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctxReader{ctx: ctx, rc: f}, nil
+}
+
+// Stat returns the attributes of a bucket file without reading its data, failing with ErrNotFound if there is no
+// such file
+func (fm *FileMgr) Stat(ctx context.Context, bucketName string, fileName string) (*ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dataPath, metaPath, err := fm.paths(bucketName, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return nil, fileErr(err)
+	}
+
+	//directories hold other objects rather than being objects themselves
+	if info.IsDir() {
+		return nil, classify(storage.ErrObjectNotExist)
+	}
+
+	meta, err := fm.readMeta(dataPath, metaPath, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta.objectInfo(bucketName, fileName, info.Size()), nil
+}
+
+// GetBucketFileRange returns a reader for length bytes of a bucket file starting at offset, which the caller must close.
+// A negative offset counts back from the end of the object and must be used with a negative length, which reads to the end
+func (fm *FileMgr) GetBucketFileRange(ctx context.Context, bucketName string, fileName string, offset, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dataPath, _, err := fm.paths(bucketName, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	f, info, err := openData(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := rangeReader(f, info.Size(), offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctxReader{ctx: ctx, rc: rc}, nil
+}
+
+// StreamBucketFile copies a bucket file into w, returning the number of bytes copied
+func (fm *FileMgr) StreamBucketFile(ctx context.Context, bucketName string, fileName string, w io.Writer) (int64, error) {
+	return streamBucketFile(ctx, fm, bucketName, fileName, w)
+}
+
+// WriteBucketFile writes a file byte array to a bucket file
+func (fm *FileMgr) WriteBucketFile(ctx context.Context, bucketName string, fileName string, data []byte) error {
+	_, err := fm.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), nil)
+	return err
+}
+
+// WriteBucketFileData writes a file byte array to a bucket file, returning the object attributes once the write has been committed
+func (fm *FileMgr) WriteBucketFileData(ctx context.Context, bucketName string, fileName string, data []byte) (*ObjectInfo, error) {
+	return fm.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), nil)
+}
+
+// WriteBucketFileFrom streams the contents of r into a bucket file, returning the object attributes once the write has been committed.
+// The data is staged in a temporary file, and only replaces the object once it has been completely received
+func (fm *FileMgr) WriteBucketFileFrom(ctx context.Context, bucketName string, fileName string, r io.Reader, opts *WriteOptions) (*ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dataPath, metaPath, err := fm.paths(bucketName, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opts.conditions().validate(false); err != nil {
+		return nil, err
+	}
+
+	contentType, r := opts.contentType(r)
+
+	oh := newObjectHasher()
+	tmpPath, err := fm.writeTemp(io.TeeReader(&ctxReader{ctx: ctx, rc: io.NopCloser(r)}, oh))
+	if err != nil {
+		return nil, classify(err)
+	}
+	defer os.Remove(tmpPath)
+
+	info := &ObjectInfo{
+		Bucket:         bucketName,
+		Name:           fileName,
+		ContentType:    contentType,
+		Metageneration: 1,
+	}
+	oh.fill(info)
+
+	if opts != nil {
+		info.ContentEncoding = opts.ContentEncoding
+		info.Metadata = maps.Clone(opts.Metadata)
+	}
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	if cond := opts.conditions(); cond != nil {
+		cur, err := fm.existing(bucketName, fileName, dataPath, metaPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := cond.check(cur); err != nil {
+			return nil, err
+		}
+	}
+
+	//each write creates a new generation of the object
+	info.Created = time.Now().UTC()
+	info.Updated = info.Created
+	info.Generation = fm.nextGeneration(metaPath, info.Created)
+	info.ETag = strconv.FormatInt(info.Generation, 10)
+
+	metaData, err := json.Marshal(fileMetaFromInfo(info))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fm.commit(tmpPath, dataPath, metaPath, metaData); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// WriteBucketFileIf writes a file byte array to a bucket file if the existing object meets the conditions, returning the
+// object attributes once the write has been committed. Unmet conditions fail with ErrPreconditionFailed
+func (fm *FileMgr) WriteBucketFileIf(ctx context.Context, bucketName string, fileName string, data []byte, cond *Conditions) (*ObjectInfo, error) {
+	return fm.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), &WriteOptions{Conditions: cond})
+}
+
+// Copy copies a bucket file to another name, which may be in another bucket
+func (fm *FileMgr) Copy(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	_, info, err := fm.copy(ctx, srcBucket, srcName, dstBucket, dstName)
+	return info, err
+}
+
+// Move moves a bucket file to another name, which may be in another bucket, by copying it and then deleting the
+// original. The original is only deleted if it has not been replaced since it was copied, and otherwise both objects
+// are kept and ErrPreconditionFailed is returned
+func (fm *FileMgr) Move(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	//moving an object onto itself would delete it
+	if srcBucket == dstBucket && srcName == dstName {
+		return fm.Stat(ctx, srcBucket, srcName)
+	}
+
+	src, info, err := fm.copy(ctx, srcBucket, srcName, dstBucket, dstName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fm.RemoveFileIf(ctx, srcBucket, srcName, &Conditions{GenerationMatch: src.Generation}); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// copy copies an object to the destination, returning the attributes of the source which was copied and of the copy
+func (fm *FileMgr) copy(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, *ObjectInfo, error) {
+	f, src, err := fm.openVersion(ctx, srcBucket, srcName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := fm.WriteBucketFileFrom(ctx, dstBucket, dstName, f, &WriteOptions{
+		ContentType:     src.ContentType,
+		ContentEncoding: src.ContentEncoding,
+		Metadata:        src.Metadata,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, info, nil
+}
+
+// openVersion opens the data file of an object along with its attributes. Objects are replaced by rename, so the open
+// file keeps the data which the attributes describe
+func (fm *FileMgr) openVersion(ctx context.Context, bucketName string, fileName string) (*os.File, *ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	dataPath, metaPath, err := fm.paths(bucketName, fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	info, err := fm.existing(bucketName, fileName, dataPath, metaPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if info == nil {
+		return nil, nil, classify(storage.ErrObjectNotExist)
+	}
+
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return nil, nil, fileErr(err)
+	}
+
+	return f, info, nil
+}
+
+// Compose concatenates the source objects into the destination, in order, streaming them into a new file in rounds of
+// 32 as GCS does
+func (fm *FileMgr) Compose(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	return composeObjects(ctx, fm, gcsComposeLimit, bucketName, dstName, srcNames, opts)
+}
+
+// composeOnce concatenates the source objects into the destination
+func (fm *FileMgr) composeOnce(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	readers := make([]io.Reader, 0, len(srcNames))
+
+	for _, name := range srcNames {
+		f, _, err := fm.openVersion(ctx, bucketName, name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		readers = append(readers, f)
+	}
+
+	return fm.WriteBucketFileFrom(ctx, bucketName, dstName, io.MultiReader(readers...), composeWriteOptions(opts))
+}
+
+// removeVersion deletes a bucket file if it still has the generation in info
+func (fm *FileMgr) removeVersion(ctx context.Context, bucketName, fileName string, info *ObjectInfo) error {
+	return fm.RemoveFileIf(ctx, bucketName, fileName, &Conditions{GenerationMatch: info.Generation})
+}
+
+// Update replaces the data of a bucket file with the result of fn, retrying if the object changes in the meantime
+func (fm *FileMgr) Update(ctx context.Context, bucketName string, fileName string, fn UpdateFunc) (*ObjectInfo, error) {
+	return updateObject(ctx, fn, func() ([]byte, *ObjectInfo, error) {
+		return fm.readVersion(ctx, bucketName, fileName)
+	}, func(data []byte, cur *ObjectInfo) (*ObjectInfo, error) {
+		return fm.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), updateOptions(cur))
+	})
+}
+
+// readVersion returns the data and attributes of a bucket file, or nil attributes if there is no such file
+func (fm *FileMgr) readVersion(ctx context.Context, bucketName string, fileName string) ([]byte, *ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	dataPath, metaPath, err := fm.paths(bucketName, fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//the lock keeps the data and its sidecar metadata consistent
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	info, err := fm.existing(bucketName, fileName, dataPath, metaPath)
+	if err != nil || info == nil {
+		return nil, nil, err
+	}
+
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, nil, fileErr(err)
+	}
+
+	return data, info, nil
+}
+
+// Objects returns an iterator over the attributes of each object matching the prefix, as they were when it was called
+func (fm *FileMgr) Objects(ctx context.Context, bucketName, prefix string) *ListIterator {
+	return fm.QueryObjects(ctx, bucketName, &ListQuery{Prefix: prefix})
+}
+
+// QueryObjects returns an iterator over the attributes of each object selected by the query, as they were when it was
+// called
+func (fm *FileMgr) QueryObjects(ctx context.Context, bucketName string, q *ListQuery) *ListIterator {
+	infos, err := fm.snapshot(bucketName, q.prefix())
+	if err != nil {
+		return errIterator(ctx, err)
+	}
+
+	return q.apply(sliceIterator(ctx, infos))
+}
+
+// ListPage returns a single page of at most pageSize objects matching the prefix, starting from the page token
+// returned with the previous page. An empty token requests the first page, and a page size of zero or less uses
+// DefaultPageSize
+func (fm *FileMgr) ListPage(ctx context.Context, bucketName, prefix string, pageSize int, pageToken string) (*ObjectPage, error) {
+	return fm.ListDir(ctx, bucketName, prefix, "", pageSize, pageToken)
+}
+
+// ListDir returns a single page of at most pageSize objects and common prefixes, starting from the page token returned
+// with the previous page. Objects whose names contain the delimiter after the prefix are returned as a common prefix
+// rather than individually, which gives a directory-style listing when the delimiter is "/". An empty delimiter lists
+// every object, as ListPage does
+func (fm *FileMgr) ListDir(ctx context.Context, bucketName, prefix, delimiter string, pageSize int, pageToken string) (*ObjectPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	infos, err := fm.snapshot(bucketName, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return pageSlice(infos, prefix, delimiter, pageSize, pageToken)
+}
+
+// ListObjects returns a configurable buffered channel which contains the attributes of each object matching the prefix
+func (fm *FileMgr) ListObjects(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan ObjectResult, error) {
+	return fm.ListObjectsQuery(ctx, bucketName, &ListQuery{Prefix: prefix}, bufferSize)
+}
+
+// ListObjectsQuery returns a configurable buffered channel which contains the attributes of each object selected by
+// the query
+func (fm *FileMgr) ListObjectsQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan ObjectResult, error) {
+	it, err := fm.queryIterator(ctx, bucketName, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamIterator(ctx, it, bufferSize), nil
+}
+
+// queryIterator returns an iterator over the objects selected by the query, reporting an invalid query or unreadable
+// bucket before the listing starts
+func (fm *FileMgr) queryIterator(ctx context.Context, bucketName string, q *ListQuery) (*ListIterator, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	infos, err := fm.snapshot(bucketName, q.prefix())
+	if err != nil {
+		return nil, err
+	}
+
+	return q.apply(sliceIterator(ctx, infos)), nil
+}
+
+// ListObjectsByTime returns a configurable buffered channel which contains the attributes of each object matching the
+// prefix which was created between start and end
+func (fm *FileMgr) ListObjectsByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan ObjectResult, error) {
+	//if the dates are not available, then exit with error
+	if start == nil || end == nil {
+		return nil, ErrMissingDateRange
+	}
+
+	return fm.ListObjectsQuery(ctx, bucketName, createdQuery(prefix, start, end), bufferSize)
+}
+
+// ListBucket returns a configurable buffered channel which contains a subset of object metadata
+func (fm *FileMgr) ListBucket(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan interface{}, error) {
+	return fm.ListBucketQuery(ctx, bucketName, &ListQuery{Prefix: prefix}, bufferSize)
+}
+
+// ListBucketByTime returns a configurable buffered channel which contains a subset of object metadata
+func (fm *FileMgr) ListBucketByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan interface{}, error) {
+	//if the dates are not available, then exit with error
+	if start == nil || end == nil {
+		return nil, ErrMissingDateRange
+	}
+
+	return fm.ListBucketQuery(ctx, bucketName, createdQuery(prefix, start, end), bufferSize)
+}
+
+// ListBucketQuery returns a configurable buffered channel which contains a subset of object metadata for each object
+// selected by the query
+func (fm *FileMgr) ListBucketQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan interface{}, error) {
+	it, err := fm.queryIterator(ctx, bucketName, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamAttrs(ctx, it, bufferSize), nil
+}
+
+// RemoveFile deletes a bucket file
+func (fm *FileMgr) RemoveFile(ctx context.Context, bucketName string, fileName string) error {
+	return fm.RemoveFileIf(ctx, bucketName, fileName, nil)
+}
+
+// RemoveObjects deletes the objects selected by opts with bounded concurrency, and returns a result for each. Objects
+// selected by prefix are only deleted if they are unchanged since they were listed
+func (fm *FileMgr) RemoveObjects(ctx context.Context, bucketName string, opts *RemoveOptions) ([]RemoveResult, error) {
+	return removeObjects(ctx, fm, bucketName, opts)
+}
+
+// RemoveFileIf deletes a bucket file if it meets the conditions. Unmet conditions fail with ErrPreconditionFailed
+func (fm *FileMgr) RemoveFileIf(ctx context.Context, bucketName string, fileName string, cond *Conditions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dataPath, metaPath, err := fm.paths(bucketName, fileName)
+	if err != nil {
+		return err
+	}
+
+	if err := cond.validate(true); err != nil {
+		return err
+	}
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	//a directory holds other objects, so it is reported as missing rather than removed
+	cur, err := fm.existing(bucketName, fileName, dataPath, metaPath)
+	if err != nil {
+		return err
+	}
+
+	if cur == nil {
+		return classify(storage.ErrObjectNotExist)
+	}
+
+	if err := cond.check(cur); err != nil {
+		return err
+	}
+
+	if err := os.Remove(dataPath); err != nil {
+		return fileErr(err)
+	}
+
+	if err := os.Remove(metaPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	//tidy up any directories left empty, so that they no longer show as folders
+	fm.pruneDirs(filepath.Dir(dataPath), filepath.Join(fm.root, bucketName))
+	fm.pruneDirs(filepath.Dir(metaPath), filepath.Join(fm.root, fileMetaDir, bucketName))
+
+	return nil
+}
+
+// bucketDir returns the directory which holds a bucket
+func (fm *FileMgr) bucketDir(bucketName string) (string, error) {
+	if bucketName == "" || strings.ContainsAny(bucketName, `/\`) || strings.HasPrefix(bucketName, ".") {
+		return "", ErrInvalidBucketName
+	}
+
+	return filepath.Join(fm.root, bucketName), nil
+}
+
+// paths returns the data and sidecar metadata paths for an object
+func (fm *FileMgr) paths(bucketName, fileName string) (string, string, error) {
+	if _, err := fm.bucketDir(bucketName); err != nil {
+		return "", "", err
+	}
+
+	//object names must map onto a clean relative path, so that they cannot escape the bucket directory
+	if fileName == "" || strings.HasSuffix(fileName, "/") || strings.Contains(fileName, `\`) || path.Clean("/"+fileName) != "/"+fileName {
+		return "", "", ErrInvalidObjectName
+	}
+
+	return filepath.Join(fm.root, bucketName, filepath.FromSlash(fileName)), fm.metaPath(bucketName, fileName), nil
+}
+
+// metaPath returns the sidecar metadata path for an object. Directories in the sidecar tree are given fileMetaDirExt,
+// so that the sidecar of one object is never needed as a directory by another, as a.json would be by a.json/b
+func (fm *FileMgr) metaPath(bucketName, fileName string) string {
+	segs := strings.Split(fileName, "/")
+	for i := range segs[:len(segs)-1] {
+		segs[i] += fileMetaDirExt
+	}
+	segs[len(segs)-1] += fileMetaExt
+
+	return filepath.Join(append([]string{fm.root, fileMetaDir, bucketName}, segs...)...)
+}
+
+// commit moves the staged data at tmpPath into place along with its sidecar metadata. The sidecar is replaced first,
+// and put back if the data cannot be moved, so that an object is never left with metadata from another write. It
+// must be called with the write lock held
+func (fm *FileMgr) commit(tmpPath, dataPath, metaPath string, metaData []byte) error {
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0o755); err != nil {
+		return clashErr(err)
+	}
+
+	//an object cannot replace the directory which holds other objects
+	if fi, err := os.Lstat(dataPath); err == nil && fi.IsDir() {
+		return ErrInvalidObjectName
+	}
+
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0o755); err != nil {
+		return classify(err)
+	}
+
+	metaTmp, err := fm.writeTemp(bytes.NewReader(metaData))
+	if err != nil {
+		return classify(err)
+	}
+	defer os.Remove(metaTmp)
+
+	//the current sidecar is kept until the data is in place
+	backup := metaTmp + ".old"
+	if err := os.Rename(metaPath, backup); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return classify(err)
+		}
+		backup = ""
+	}
+
+	restore := func() {
+		if backup != "" {
+			os.Rename(backup, metaPath)
+		} else {
+			os.Remove(metaPath)
+		}
+	}
+
+	if err := os.Rename(metaTmp, metaPath); err != nil {
+		restore()
+		return classify(err)
+	}
+
+	if err := os.Rename(tmpPath, dataPath); err != nil {
+		restore()
+		return clashErr(err)
+	}
+
+	if backup != "" {
+		os.Remove(backup)
+	}
+
+	return nil
+}
+
+// writeTemp copies r into a new temporary file and returns the file path
+func (fm *FileMgr) writeTemp(r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(fm.root, fileTempDir), "obj-*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// readMeta returns the sidecar metadata for an object, falling back to the file itself if the sidecar is missing
+func (fm *FileMgr) readMeta(dataPath, metaPath string, info fs.FileInfo) (*fileMeta, error) {
+	meta := &fileMeta{}
+
+	metaData, err := os.ReadFile(metaPath)
+	if err == nil {
+		if err := json.Unmarshal(metaData, meta); err != nil {
+			return nil, err
+		}
+
+		return meta, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	//the object was placed directly on disk, so derive what we can from the file, taking the generation from the
+	//modification time so that conditions still detect changes
+	meta.Created = info.ModTime().UTC()
+	meta.Generation = info.ModTime().UnixMicro()
+	meta.Metageneration = 1
+
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	meta.ContentType = http.DetectContentType(head[:n])
+
+	return meta, nil
+}
+
+// snapshot returns the object attributes for a bucket prefix, ordered by name
+func (fm *FileMgr) snapshot(bucketName, prefix string) ([]*ObjectInfo, error) {
+	bucketDir, err := fm.bucketDir(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	//start walking from the deepest directory named by the prefix
+	walkDir := bucketDir
+	if i := strings.LastIndex(prefix, "/"); i > 0 && path.Clean("/"+prefix[:i]) == "/"+prefix[:i] {
+		walkDir = filepath.Join(bucketDir, filepath.FromSlash(prefix[:i]))
+	}
+
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+
+	var infos []*ObjectInfo
+	err = filepath.WalkDir(walkDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(bucketDir, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		meta, err := fm.readMeta(p, fm.metaPath(bucketName, name), info)
+		if err != nil {
+			return err
+		}
+
+		infos = append(infos, meta.objectInfo(bucketName, name, info.Size()))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos, nil
+}
+
+// existing returns the attributes of an object for checking conditions, or nil if there is no such object
+func (fm *FileMgr) existing(bucketName, fileName, dataPath, metaPath string) (*ObjectInfo, error) {
+	info, err := os.Stat(dataPath)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) || (err == nil && info.IsDir()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	meta, err := fm.readMeta(dataPath, metaPath, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta.objectInfo(bucketName, fileName, info.Size()), nil
+}
+
+// nextGeneration returns a generation number for a new write of an object, which is always greater than that of the
+// current object. It must be called with the write lock held
+func (fm *FileMgr) nextGeneration(metaPath string, now time.Time) int64 {
+	gen := now.UnixMicro()
+
+	meta := &fileMeta{}
+	if metaData, err := os.ReadFile(metaPath); err == nil && json.Unmarshal(metaData, meta) == nil {
+		gen = max(gen, meta.Generation+1)
+	}
+
+	return gen
+}
+
+// fileMetaFromInfo returns the sidecar metadata for an object
+func fileMetaFromInfo(info *ObjectInfo) *fileMeta {
+	return &fileMeta{
+		ContentType:     info.ContentType,
+		ContentEncoding: info.ContentEncoding,
+		Created:         info.Created,
+		Updated:         info.Updated,
+		Generation:      info.Generation,
+		Metageneration:  info.Metageneration,
+		MD5:             info.MD5,
+		CRC32C:          info.CRC32C,
+		Metadata:        info.Metadata,
+	}
+}
+
+// objectInfo returns the attributes of an object from its sidecar metadata
+func (meta *fileMeta) objectInfo(bucketName, fileName string, size int64) *ObjectInfo {
+	info := &ObjectInfo{
+		Bucket:          bucketName,
+		Name:            fileName,
+		Size:            size,
+		ContentType:     meta.ContentType,
+		ContentEncoding: meta.ContentEncoding,
+		Created:         meta.Created,
+		Updated:         meta.Updated,
+		Generation:      meta.Generation,
+		Metageneration:  meta.Metageneration,
+		MD5:             meta.MD5,
+		CRC32C:          meta.CRC32C,
+		Metadata:        meta.Metadata,
+	}
+
+	if info.Generation != 0 {
+		info.ETag = strconv.FormatInt(info.Generation, 10)
+	}
+
+	return info
+}
+
+// pruneDirs removes empty directories from dir upwards, stopping at stop
+func (fm *FileMgr) pruneDirs(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// clashErr maps the errors from placing an object where another object needs a directory, or the reverse, onto
+// ErrInvalidObjectName
+func clashErr(err error) error {
+	if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EISDIR) || errors.Is(err, syscall.EEXIST) || errors.Is(err, syscall.ENOTEMPTY) {
+		return ErrInvalidObjectName
+	}
+
+	return classify(err)
+}
+
+// openData opens the data file of an object, failing with ErrNotFound if the path is a directory, which holds other
+// objects rather than being one itself
+func openData(dataPath string) (*os.File, fs.FileInfo, error) {
+	f, err := os.Open(dataPath)
+	if err != nil {
+		return nil, nil, fileErr(err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, classify(storage.ErrObjectNotExist)
+	}
+
+	return f, info, nil
+}
+
+// fileErr maps filesystem errors onto their storage equivalents
+func fileErr(err error) error {
+	//a file standing in for a parent directory also means that the object does not exist
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		return classify(storage.ErrObjectNotExist)
+	}
+
+	return classify(err)
+}
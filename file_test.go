@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func Test_FileWriteReadRemove(t *testing.T) {
+	ctx := context.Background()
+
+	sto, err := NewFileMgr(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//read in the file data
+	dat, err := getLocalFileData(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//write to the test bucket, beneath a folder
+	err = sto.WriteBucketFile(ctx, "filebucket", "tests/"+testFile, dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the object should be a plain file within the bucket directory
+	if _, err := os.Stat(filepath.Join(sto.root, "filebucket", "tests", testFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := sto.GetBucketFileData(ctx, "filebucket", "tests/"+testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(dat) {
+		t.Fatalf("read %q, want %q", got, dat)
+	}
+
+	err = sto.RemoveFile(ctx, "filebucket", "tests/"+testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the emptied folder should have been tidied away
+	if _, err := os.Stat(filepath.Join(sto.root, "filebucket", "tests")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("folder still present after remove: %v", err)
+	}
+
+	_, err = sto.GetBucketFileData(ctx, "filebucket", "tests/"+testFile)
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("read after remove returned %v, want ErrObjectNotExist", err)
+	}
+}
+
+func Test_FileInvalidNames(t *testing.T) {
+	ctx := context.Background()
+
+	sto, err := NewFileMgr(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "../escape", "a/../../escape", "/abs", "folder/"} {
+		if err := sto.WriteBucketFile(ctx, "filebucket", name, nil); err != ErrInvalidObjectName {
+			t.Fatalf("write of %q returned %v, want ErrInvalidObjectName", name, err)
+		}
+	}
+
+	if err := sto.WriteBucketFile(ctx, ".meta", "x", nil); err != ErrInvalidBucketName {
+		t.Fatalf("write to .meta returned %v, want ErrInvalidBucketName", err)
+	}
+}
+
+func Test_FileNameClashes(t *testing.T) {
+	ctx := context.Background()
+
+	sto, err := NewFileMgr(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//an object whose name extends another's sidecar name is stored alongside it, in either order
+	for _, names := range [][]string{{"d", "d.json/x"}, {"e.json/x", "e"}} {
+		for _, name := range names {
+			if err := sto.WriteBucketFile(ctx, "filebucket", name, []byte(name)); err != nil {
+				t.Fatalf("write of %s returned %v", name, err)
+			}
+		}
+
+		for _, name := range names {
+			info, err := sto.Stat(ctx, "filebucket", name)
+			if err != nil || info.Size != int64(len(name)) {
+				t.Fatalf("stat of %s returned %+v, %v", name, info, err)
+			}
+		}
+	}
+
+	if objs := collectObjects(t, mustList(t, sto, "filebucket", &ListQuery{})); len(objs) != 4 {
+		t.Fatalf("listing returned %d objects, want 4", len(objs))
+	}
+
+	//an object cannot also be the directory of another, and the failed write leaves nothing behind
+	for _, names := range [][]string{{"a", "a/b"}, {"c/d", "c"}} {
+		if err := sto.WriteBucketFile(ctx, "filebucket", names[0], []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := sto.WriteBucketFile(ctx, "filebucket", names[1], []byte("y")); err != ErrInvalidObjectName {
+			t.Fatalf("write of %s over %s returned %v, want ErrInvalidObjectName", names[1], names[0], err)
+		}
+
+		if _, err := sto.Stat(ctx, "filebucket", names[1]); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("stat of clashing %s returned %v, want ErrNotFound", names[1], err)
+		}
+
+		if data, err := sto.GetBucketFileData(ctx, "filebucket", names[0]); err != nil || string(data) != "x" {
+			t.Fatalf("read of %s returned %q, %v", names[0], data, err)
+		}
+	}
+
+	if objs := collectObjects(t, mustList(t, sto, "filebucket", &ListQuery{})); len(objs) != 6 {
+		t.Fatalf("listing returned %d objects, want 6", len(objs))
+	}
+
+	//the directory holding c/d is not an object itself
+	if _, err := sto.GetBucketFileReader(ctx, "filebucket", "c"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("reader for directory returned %v, want ErrNotFound", err)
+	}
+
+	if _, err := sto.GetBucketFileData(ctx, "filebucket", "c"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("read of directory returned %v, want ErrNotFound", err)
+	}
+
+	if _, err := sto.GetBucketFileRange(ctx, "filebucket", "c", 0, 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("range read of directory returned %v, want ErrNotFound", err)
+	}
+
+	if err := sto.RemoveFile(ctx, "filebucket", "c"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("remove of directory returned %v, want ErrNotFound", err)
+	}
+
+	if _, err := sto.Stat(ctx, "filebucket", "c/d"); err != nil {
+		t.Fatalf("stat of c/d after removing its directory returned %v", err)
+	}
+}
+
+func Test_FileWriteAllocs(t *testing.T) {
+	ctx := context.Background()
+
+	sto, err := NewFileMgr(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a small write is copied straight into the file rather than through a chunk sized buffer
+	n := allocBytes(t, func() {
+		if err := sto.WriteBucketFile(ctx, "filebucket", testFile, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if n > 1<<20 {
+		t.Fatalf("two byte write allocated %d bytes", n)
+	}
+}
+
+func Test_FileListBucket(t *testing.T) {
+	ctx := context.Background()
+
+	sto, err := NewFileMgr(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"b/2.json", "a/1.json", "b/1.json", "b-c.json", "c.json"} {
+		if err := sto.WriteBucketFile(ctx, "filebucket", name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rfchn, err := sto.ListBucket(ctx, "filebucket", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//names should be in lexical order, as with GCS
+	names := collectListing(t, rfchn)
+	want := []string{"a/1.json", "b-c.json", "b/1.json", "b/2.json", "c.json"}
+	if len(names) != len(want) {
+		t.Fatalf("unexpected listing %v", names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("unexpected listing %v", names)
+		}
+	}
+
+	//prefixes need not end on a folder boundary
+	rfchn, err = sto.ListBucket(ctx, "filebucket", "b", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 3 {
+		t.Fatalf("unexpected prefix listing %v", names)
+	}
+
+	rfchn, err = sto.ListBucket(ctx, "filebucket", "b/2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 1 || names[0] != "b/2.json" {
+		t.Fatalf("unexpected prefix listing %v", names)
+	}
+
+	//a missing bucket lists nothing
+	rfchn, err = sto.ListBucket(ctx, "nobucket", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 0 {
+		t.Fatalf("unexpected listing %v", names)
+	}
+}
+
+func Test_FileListBucketByTime(t *testing.T) {
+	ctx := context.Background()
+
+	sto, err := NewFileMgr(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sto.WriteBucketFile(ctx, "filebucket", testFile, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	//push the file mtime into the past, which should not affect the stored created time
+	old := time.Now().AddDate(-1, 0, 0)
+	if err := os.Chtimes(filepath.Join(sto.root, "filebucket", testFile), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+
+	rfchn, err := sto.ListBucketByTime(ctx, "filebucket", "", &start, &end, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 1 {
+		t.Fatalf("unexpected listing %v", names)
+	}
+
+	_, err = sto.ListBucketByTime(ctx, "filebucket", "", &start, nil, 1)
+	if err != ErrMissingDateRange {
+		t.Fatalf("missing end date returned %v, want ErrMissingDateRange", err)
+	}
+}
@@ -0,0 +1,757 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	raw "google.golang.org/api/storage/v1"
+)
+
+// gcsFakeObject is an object held by gcsFake
+type gcsFakeObject struct {
+	attrs raw.Object
+	data  []byte
+}
+
+// gcsFakeUpload is a resumable upload in progress
+type gcsFakeUpload struct {
+	bucket string
+	attrs  raw.Object
+	data   []byte
+	//query holds the parameters of the request which started the upload, including any preconditions
+	query url.Values
+}
+
+// gcsFake is a minimal GCS emulator serving the parts of the JSON and XML APIs which StorMgr uses
+type gcsFake struct {
+	t       *testing.T
+	mu      sync.Mutex
+	buckets map[string]map[string]*gcsFakeObject
+	uploads map[string]*gcsFakeUpload
+	gen     int64
+	//lastList holds the query parameters of the most recent listing request
+	lastList url.Values
+	//rewriteChunk, when set, is the number of bytes copied by each rewrite call, and rewrites counts the calls
+	rewriteChunk int64
+	rewrites     int
+	//composes counts the compose calls
+	composes int
+	//failStatus and failReason, when set, make every request fail with that error
+	failStatus int
+	failReason string
+	//glob, when set, replaces fakeGlob for matching listing glob patterns
+	glob func(pattern string) (func(name string) bool, error)
+}
+
+// newGCSFake starts a GCS emulator with an empty bucket, and returns its URL
+func newGCSFake(t *testing.T, bucketName string) (*gcsFake, string) {
+	t.Helper()
+
+	fk := &gcsFake{
+		t:       t,
+		buckets: map[string]map[string]*gcsFakeObject{bucketName: {}},
+		uploads: make(map[string]*gcsFakeUpload),
+		gen:     time.Now().UnixMicro(),
+	}
+
+	srv := httptest.NewServer(fk)
+	t.Cleanup(srv.Close)
+
+	return fk, srv.URL
+}
+
+// fail writes a JSON API error response
+func (fk *gcsFake) fail(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": reason,
+			"errors":  []map[string]string{{"reason": reason, "message": reason}},
+		},
+	})
+}
+
+// reply writes a JSON response
+func (fk *gcsFake) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// segments splits an escaped path into its unescaped segments, so that object names may contain slashes
+func (fk *gcsFake) segments(r *http.Request) []string {
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i, p := range parts {
+		if u, err := url.PathUnescape(p); err == nil {
+			parts[i] = u
+		}
+	}
+
+	return parts
+}
+
+// ServeHTTP routes requests to the JSON API, upload and XML API handlers
+func (fk *gcsFake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+
+	if fk.failStatus != 0 {
+		fk.fail(w, fk.failStatus, fk.failReason)
+		return
+	}
+
+	seg := fk.segments(r)
+
+	switch {
+	case len(seg) == 6 && seg[0] == "upload" && seg[3] == "b" && seg[5] == "o":
+		fk.upload(w, r, seg[4])
+	case len(seg) == 5 && seg[0] == "storage" && seg[2] == "b" && seg[4] == "o":
+		fk.list(w, r, seg[3])
+	case len(seg) == 6 && seg[0] == "storage" && seg[2] == "b" && seg[4] == "o":
+		fk.object(w, r, seg[3], seg[5])
+	case len(seg) == 7 && seg[0] == "storage" && seg[6] == "compose" && r.Method == http.MethodPost:
+		fk.compose(w, r, seg[3], seg[5])
+	case len(seg) == 11 && seg[0] == "storage" && seg[6] == "rewriteTo" && r.Method == http.MethodPost:
+		fk.rewrite(w, r, seg[3], seg[5], seg[8], seg[10])
+	case len(seg) >= 2:
+		fk.read(w, r, seg[0], strings.Join(seg[1:], "/"))
+	default:
+		fk.fail(w, http.StatusNotFound, "notFound")
+	}
+}
+
+// bucket returns a bucket, writing a not found response if it is missing
+func (fk *gcsFake) bucket(w http.ResponseWriter, bucketName string) (map[string]*gcsFakeObject, bool) {
+	bkt, ok := fk.buckets[bucketName]
+	if !ok {
+		fk.fail(w, http.StatusNotFound, "notFound")
+	}
+
+	return bkt, ok
+}
+
+// put stores an object, assigning it a new generation and checksums
+func (fk *gcsFake) put(bucketName string, attrs raw.Object, data []byte) *gcsFakeObject {
+	fk.gen++
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	sum := md5.Sum(data)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+
+	attrs.Bucket = bucketName
+	attrs.Size = uint64(len(data))
+	attrs.Generation = fk.gen
+	attrs.Metageneration = 1
+	attrs.TimeCreated = now
+	attrs.Updated = now
+	attrs.Md5Hash = base64.StdEncoding.EncodeToString(sum[:])
+	attrs.Crc32c = base64.StdEncoding.EncodeToString(crc)
+	attrs.Etag = strconv.FormatInt(fk.gen, 10)
+	if attrs.ContentType == "" {
+		attrs.ContentType = http.DetectContentType(data)
+	}
+
+	obj := &gcsFakeObject{attrs: attrs, data: data}
+	fk.buckets[bucketName][attrs.Name] = obj
+
+	return obj
+}
+
+// upload handles multipart and resumable media uploads
+func (fk *gcsFake) upload(w http.ResponseWriter, r *http.Request, bucketName string) {
+	if _, ok := fk.bucket(w, bucketName); !ok {
+		return
+	}
+
+	q := r.URL.Query()
+
+	switch {
+	case q.Get("uploadType") == "multipart":
+		fk.uploadMultipart(w, r, bucketName)
+	case q.Get("uploadType") == "resumable" && q.Get("upload_id") == "":
+		var attrs raw.Object
+		if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+			fk.fail(w, http.StatusBadRequest, "invalid")
+			return
+		}
+
+		id := strconv.Itoa(len(fk.uploads) + 1)
+		fk.uploads[id] = &gcsFakeUpload{bucket: bucketName, attrs: attrs, query: q}
+
+		q.Set("upload_id", id)
+		w.Header().Set("Location", "http://"+r.Host+r.URL.Path+"?"+q.Encode())
+	case q.Get("uploadType") == "resumable":
+		fk.uploadChunk(w, r, q.Get("upload_id"))
+	default:
+		fk.fail(w, http.StatusBadRequest, "invalid")
+	}
+}
+
+// uploadMultipart handles single request uploads, which carry the metadata and data as a multipart body
+func (fk *gcsFake) uploadMultipart(w http.ResponseWriter, r *http.Request, bucketName string) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		fk.fail(w, http.StatusBadRequest, "invalid")
+		return
+	}
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	var attrs raw.Object
+	part, err := mr.NextPart()
+	if err != nil || json.NewDecoder(part).Decode(&attrs) != nil {
+		fk.fail(w, http.StatusBadRequest, "invalid")
+		return
+	}
+
+	part, err = mr.NextPart()
+	if err != nil {
+		fk.fail(w, http.StatusBadRequest, "invalid")
+		return
+	}
+
+	data, err := io.ReadAll(part)
+	if err != nil {
+		fk.fail(w, http.StatusBadRequest, "invalid")
+		return
+	}
+
+	if attrs.ContentType == "" {
+		attrs.ContentType = part.Header.Get("Content-Type")
+	}
+
+	if !fk.preconditions(w, r.URL.Query(), fk.buckets[bucketName][attrs.Name]) {
+		return
+	}
+
+	obj := fk.put(bucketName, attrs, data)
+	fk.reply(w, obj.attrs)
+}
+
+// uploadChunk handles a chunk of a resumable upload, committing the object once the final chunk arrives
+func (fk *gcsFake) uploadChunk(w http.ResponseWriter, r *http.Request, id string) {
+	up, ok := fk.uploads[id]
+	if !ok {
+		fk.fail(w, http.StatusNotFound, "notFound")
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		fk.fail(w, http.StatusBadRequest, "invalid")
+		return
+	}
+
+	//Content-Range is either "bytes first-last/total" or "bytes */total", where total is * until the final chunk
+	rng := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	span, total, _ := strings.Cut(rng, "/")
+	if span != "*" {
+		first, _, _ := strings.Cut(span, "-")
+		if off, err := strconv.Atoi(first); err != nil || off != len(up.data) {
+			fk.fail(w, http.StatusBadRequest, "invalid")
+			return
+		}
+	}
+
+	up.data = append(up.data, data...)
+
+	if total == "*" {
+		//the client asks for a 200 carrying an override header, rather than the 308 which Go would treat as a redirect
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(up.data)-1))
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		return
+	}
+
+	delete(fk.uploads, id)
+
+	if !fk.preconditions(w, up.query, fk.buckets[up.bucket][up.attrs.Name]) {
+		return
+	}
+
+	obj := fk.put(up.bucket, up.attrs, up.data)
+	fk.reply(w, obj.attrs)
+}
+
+// preconditions checks the generation preconditions of a request against the current object, which is nil if there is
+// none, writing a failure response if they are not met
+func (fk *gcsFake) preconditions(w http.ResponseWriter, q url.Values, obj *gcsFakeObject) bool {
+	met := true
+
+	if q.Has("ifGenerationMatch") {
+		gen, _ := strconv.ParseInt(q.Get("ifGenerationMatch"), 10, 64)
+		if obj == nil {
+			met = gen == 0
+		} else {
+			met = obj.attrs.Generation == gen
+		}
+	}
+
+	if q.Has("ifMetagenerationMatch") {
+		metagen, _ := strconv.ParseInt(q.Get("ifMetagenerationMatch"), 10, 64)
+		met = met && obj != nil && obj.attrs.Metageneration == metagen
+	}
+
+	if !met {
+		fk.fail(w, http.StatusPreconditionFailed, "conditionNotMet")
+	}
+
+	return met
+}
+
+// list handles object listing
+func (fk *gcsFake) list(w http.ResponseWriter, r *http.Request, bucketName string) {
+	bkt, ok := fk.bucket(w, bucketName)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	fk.lastList = q
+
+	match := func(string) bool { return true }
+	if q.Get("matchGlob") != "" {
+		glob := fakeGlob
+		if fk.glob != nil {
+			glob = fk.glob
+		}
+
+		var err error
+		if match, err = glob(q.Get("matchGlob")); err != nil {
+			fk.fail(w, http.StatusBadRequest, "invalid")
+			return
+		}
+	}
+
+	var names []string
+	for name := range bkt {
+		if name >= q.Get("startOffset") && (q.Get("endOffset") == "" || name < q.Get("endOffset")) && match(name) {
+			names = append(names, name)
+		}
+	}
+
+	entries := delimitNames(names, q.Get("prefix"), q.Get("delimiter"), q.Get("pageToken"))
+
+	res := &raw.Objects{Kind: "storage#objects"}
+
+	maxResults, _ := strconv.Atoi(q.Get("maxResults"))
+	if maxResults > 0 && len(entries) > maxResults {
+		entries = entries[:maxResults]
+		res.NextPageToken = entries[len(entries)-1].name
+	}
+
+	for _, e := range entries {
+		if e.dir {
+			res.Prefixes = append(res.Prefixes, e.name)
+			continue
+		}
+		attrs := bkt[e.name].attrs
+		res.Items = append(res.Items, &attrs)
+	}
+
+	fk.reply(w, res)
+}
+
+// object handles JSON API object metadata requests and deletes
+func (fk *gcsFake) object(w http.ResponseWriter, r *http.Request, bucketName, name string) {
+	bkt, ok := fk.bucket(w, bucketName)
+	if !ok {
+		return
+	}
+
+	obj, ok := bkt[name]
+	if !ok {
+		fk.fail(w, http.StatusNotFound, "notFound")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		fk.reply(w, obj.attrs)
+	case http.MethodDelete:
+		if !fk.preconditions(w, r.URL.Query(), obj) {
+			return
+		}
+		delete(bkt, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fk.fail(w, http.StatusMethodNotAllowed, "invalid")
+	}
+}
+
+// rewrite handles object copies. When rewriteChunk is set, each call copies that many bytes and returns a rewrite
+// token for the next call, until the whole object has been copied
+func (fk *gcsFake) rewrite(w http.ResponseWriter, r *http.Request, srcBucket, srcName, dstBucket, dstName string) {
+	src, ok := fk.bucket(w, srcBucket)
+	if !ok {
+		return
+	}
+
+	dst, ok := fk.bucket(w, dstBucket)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+
+	obj, ok := src[srcName]
+	if !ok || (q.Has("sourceGeneration") && q.Get("sourceGeneration") != strconv.FormatInt(obj.attrs.Generation, 10)) {
+		fk.fail(w, http.StatusNotFound, "notFound")
+		return
+	}
+
+	fk.rewrites++
+
+	size := int64(len(obj.data))
+	done := size
+	if fk.rewriteChunk > 0 {
+		offset, _ := strconv.ParseInt(q.Get("rewriteToken"), 10, 64)
+		done = min(offset+fk.rewriteChunk, size)
+	}
+
+	res := &raw.RewriteResponse{
+		Kind:                "storage#rewriteResponse",
+		ObjectSize:          size,
+		TotalBytesRewritten: done,
+		Done:                done == size,
+	}
+
+	if !res.Done {
+		res.RewriteToken = strconv.FormatInt(done, 10)
+		fk.reply(w, res)
+		return
+	}
+
+	if !fk.preconditions(w, q, dst[dstName]) {
+		return
+	}
+
+	attrs := obj.attrs
+	attrs.Name = dstName
+	res.Resource = &fk.put(dstBucket, attrs, obj.data).attrs
+
+	fk.reply(w, res)
+}
+
+// compose handles object composition, which like GCS accepts at most 32 sources
+func (fk *gcsFake) compose(w http.ResponseWriter, r *http.Request, bucketName, name string) {
+	bkt, ok := fk.bucket(w, bucketName)
+	if !ok {
+		return
+	}
+
+	var req raw.ComposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.SourceObjects) == 0 || len(req.SourceObjects) > 32 {
+		fk.fail(w, http.StatusBadRequest, "invalid")
+		return
+	}
+
+	var data []byte
+	for _, src := range req.SourceObjects {
+		obj, ok := bkt[src.Name]
+		if !ok {
+			fk.fail(w, http.StatusNotFound, "notFound")
+			return
+		}
+		data = append(data, obj.data...)
+	}
+
+	if !fk.preconditions(w, r.URL.Query(), bkt[name]) {
+		return
+	}
+
+	fk.composes++
+
+	var attrs raw.Object
+	if req.Destination != nil {
+		attrs = *req.Destination
+	}
+	attrs.Name = name
+
+	fk.reply(w, fk.put(bucketName, attrs, data).attrs)
+}
+
+// read handles XML API object downloads
+func (fk *gcsFake) read(w http.ResponseWriter, r *http.Request, bucketName, name string) {
+	obj, ok := fk.buckets[bucketName][name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", obj.attrs.ContentType)
+	hdr.Set("X-Goog-Generation", strconv.FormatInt(obj.attrs.Generation, 10))
+	hdr.Set("X-Goog-Metageneration", strconv.FormatInt(obj.attrs.Metageneration, 10))
+	hdr.Add("X-Goog-Hash", "crc32c="+obj.attrs.Crc32c)
+	hdr.Add("X-Goog-Hash", "md5="+obj.attrs.Md5Hash)
+	if obj.attrs.ContentEncoding != "" {
+		hdr.Set("Content-Encoding", obj.attrs.ContentEncoding)
+	}
+
+	data := obj.data
+	status := http.StatusOK
+
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end, ok := parseRange(rng, int64(len(data)))
+		if !ok {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		hdr.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+		data = data[start:end]
+		status = http.StatusPartialContent
+	}
+
+	hdr.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+// fakeEntry is an object or common prefix in a fake listing
+type fakeEntry struct {
+	name string
+	dir  bool
+}
+
+// delimitNames returns the ordered listing entries after token for the names matching the prefix, collapsing names
+// which contain the delimiter after the prefix into common prefixes
+func delimitNames(names []string, prefix, delimiter, token string) []fakeEntry {
+	sort.Strings(names)
+
+	var entries []fakeEntry
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		e := fakeEntry{name: name}
+		if i := strings.Index(name[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			e = fakeEntry{name: name[:len(prefix)+i+len(delimiter)], dir: true}
+		}
+
+		if e.name > token && (len(entries) == 0 || entries[len(entries)-1] != e) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// fakeGlob returns a matcher for a GCS glob pattern. It matches names directly, with backtracking, rather than through
+// a regular expression, so that the emulator checks globRegexp rather than sharing its mistakes
+func fakeGlob(pattern string) (func(name string) bool, error) {
+	alts, err := fakeGlobExpand(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(name string) bool {
+		for _, alt := range alts {
+			if fakeGlobMatch(alt, name) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// fakeGlobExpand expands the {a,b} alternatives in a glob pattern into separate patterns
+func fakeGlobExpand(p string) ([]string, error) {
+	depth, open := 0, -1
+	var commas []int
+
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '[':
+			end, ok := fakeGlobClassEnd(p, i)
+			if !ok {
+				return nil, ErrInvalidGlob
+			}
+			i = end
+		case '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		case '}':
+			if depth == 0 {
+				return nil, ErrInvalidGlob
+			}
+
+			depth--
+			if depth > 0 {
+				continue
+			}
+
+			var out []string
+			bounds := append(append([]int{open}, commas...), i)
+			for k := 0; k+1 < len(bounds); k++ {
+				alts, err := fakeGlobExpand(p[:open] + p[bounds[k]+1:bounds[k+1]] + p[i+1:])
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, alts...)
+			}
+
+			return out, nil
+		}
+	}
+
+	if depth > 0 {
+		return nil, ErrInvalidGlob
+	}
+
+	return []string{p}, nil
+}
+
+// fakeGlobClassEnd returns the index of the ] closing the character class which opens at p[i]
+func fakeGlobClassEnd(p string, i int) (int, bool) {
+	j := i + 1
+	if j < len(p) && p[j] == '!' {
+		j++
+	}
+	if j < len(p) && p[j] == ']' {
+		j++
+	}
+
+	end := strings.IndexByte(p[j:], ']')
+	if end < 0 {
+		return 0, false
+	}
+
+	return j + end, true
+}
+
+// fakeGlobMatch reports whether name matches a glob pattern without alternatives
+func fakeGlobMatch(p, name string) bool {
+	for len(p) > 0 {
+		switch {
+		case strings.HasPrefix(p, "**"):
+			for i := 0; i <= len(name); i++ {
+				if fakeGlobMatch(p[2:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case p[0] == '*':
+			for i := 0; i <= len(name); i++ {
+				if fakeGlobMatch(p[1:], name[i:]) {
+					return true
+				}
+				if i < len(name) && name[i] == '/' {
+					return false
+				}
+			}
+			return false
+		case p[0] == '?':
+			r, size := utf8.DecodeRuneInString(name)
+			if size == 0 || r == '/' {
+				return false
+			}
+			p, name = p[1:], name[size:]
+		case p[0] == '[':
+			end, _ := fakeGlobClassEnd(p, 0)
+			r, size := utf8.DecodeRuneInString(name)
+			if size == 0 || !fakeGlobClass(p[1:end], r) {
+				return false
+			}
+			p, name = p[end+1:], name[size:]
+		default:
+			if p[0] == '\\' && len(p) > 1 {
+				p = p[1:]
+			}
+			if name == "" || name[0] != p[0] {
+				return false
+			}
+			p, name = p[1:], name[1:]
+		}
+	}
+
+	return name == ""
+}
+
+// fakeGlobClass reports whether r is in a character class, given the text between its brackets
+func fakeGlobClass(class string, r rune) bool {
+	negate := strings.HasPrefix(class, "!")
+	if negate {
+		class = class[1:]
+	}
+
+	in := false
+	for i := 0; i < len(class); i++ {
+		lo, hi := rune(class[i]), rune(class[i])
+		if i+2 < len(class) && class[i+1] == '-' {
+			hi = rune(class[i+2])
+			i += 2
+		}
+		if lo <= r && r <= hi {
+			in = true
+		}
+	}
+
+	return in != negate
+}
+
+// parseRange parses a single byte range header, returning the half open range it selects
+func parseRange(rng string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+
+	first, last, _ := strings.Cut(spec, "-")
+
+	//a suffix range selects the final bytes of the object
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	end := size
+	if last != "" {
+		l, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		end = min(l+1, size)
+	}
+
+	return start, end, true
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"iter"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/iterator"
+)
+
+const (
+	//DefaultPageSize is the number of objects returned in each listing page when no page size is given
+	DefaultPageSize = 1000
+)
+
+// ObjectPage is a single page of a bucket listing
+type ObjectPage struct {
+	//Objects holds the attributes of the objects in the page, ordered by name
+	Objects []*ObjectInfo
+	//Prefixes holds the common prefixes in the page when listing with a delimiter, ordered by name. Each is the
+	//listing prefix followed by the object name up to and including the first delimiter
+	Prefixes []string
+	//NextPageToken is passed to ListPage to fetch the following page, and is empty on the last page
+	NextPageToken string
+}
+
+// ListIterator is a pull-based iterator over the objects in a bucket listing. Objects are fetched as Next is called,
+// so no background goroutines are used and an abandoned iterator needs no clean up
+type ListIterator struct {
+	ctx  context.Context
+	next func() (*ObjectInfo, error)
+	keep func(*ObjectInfo) bool
+	end  string
+	obj  *ObjectInfo
+	err  error
+}
+
+// newListIterator returns an iterator which calls next for each object until it returns an error, where
+// iterator.Done marks the end of the listing
+func newListIterator(ctx context.Context, next func() (*ObjectInfo, error)) *ListIterator {
+	return &ListIterator{ctx: ctx, next: next}
+}
+
+// sliceIterator returns an iterator over a listing which has already been collected
+func sliceIterator(ctx context.Context, infos []*ObjectInfo) *ListIterator {
+	return newListIterator(ctx, func() (*ObjectInfo, error) {
+		if len(infos) == 0 {
+			return nil, iterator.Done
+		}
+
+		info := infos[0]
+		infos = infos[1:]
+
+		return info, nil
+	})
+}
+
+// errIterator returns an iterator which fails with err on the first call to Next
+func errIterator(ctx context.Context, err error) *ListIterator {
+	return newListIterator(ctx, func() (*ObjectInfo, error) {
+		return nil, err
+	})
+}
+
+// Next advances the iterator to the next object, returning false once the listing is complete, the context is done
+// or an error occurs. Err reports which
+func (it *ListIterator) Next() bool {
+	it.obj = nil
+
+	if it.err != nil {
+		return false
+	}
+
+	for {
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+
+		obj, err := it.next()
+		if err == nil && it.end != "" && obj.Name >= it.end {
+			err = iterator.Done
+		}
+
+		if err != nil {
+			it.err = classify(err)
+			return false
+		}
+
+		if it.keep == nil || it.keep(obj) {
+			it.obj = obj
+			return true
+		}
+	}
+}
+
+// Object returns the attributes of the current object
+func (it *ListIterator) Object() *ObjectInfo {
+	return it.obj
+}
+
+// Err returns the error which stopped the iterator, or nil if the listing completed
+func (it *ListIterator) Err() error {
+	if it.err == iterator.Done {
+		return nil
+	}
+
+	return it.err
+}
+
+// All returns the remaining objects as a range-over-func sequence. Any error which stops the iterator is yielded
+// last, with a nil object
+func (it *ListIterator) All() iter.Seq2[*ObjectInfo, error] {
+	return func(yield func(*ObjectInfo, error) bool) {
+		for it.Next() {
+			if !yield(it.obj, nil) {
+				return
+			}
+		}
+
+		if err := it.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// streamIterator returns a buffered channel which is fed the objects from it, and closed once the iterator stops or
+// the context is done. An iterator error is sent as the final result unless the context is done
+func streamIterator(ctx context.Context, it *ListIterator, bufferSize int) <-chan ObjectResult {
+	return streamList(ctx, it, bufferSize, func(info *ObjectInfo, err error) ObjectResult {
+		return ObjectResult{Object: info, Err: err}
+	})
+}
+
+// streamList feeds the objects from it into a buffered channel from a single goroutine, converting each object, or the
+// final iterator error, into an item with fn
+func streamList[T any](ctx context.Context, it *ListIterator, bufferSize int, fn func(*ObjectInfo, error) T) <-chan T {
+	result := make(chan T, bufferSize)
+
+	go func() {
+		defer close(result)
+
+		for it.Next() {
+			select {
+			case <-ctx.Done():
+				return
+			case result <- fn(it.Object(), nil):
+			}
+		}
+
+		if err := it.Err(); err != nil && ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case result <- fn(nil, err):
+			}
+		}
+	}()
+
+	return result
+}
+
+// listEntry is an object or a common prefix in a delimited listing
+type listEntry struct {
+	name string
+	info *ObjectInfo
+}
+
+// pageSlice returns a page of a listing which has already been collected and ordered by name. Objects whose names
+// contain the delimiter after the prefix are returned as a single common prefix. The page token is the encoded name of
+// the last object or prefix in the previous page
+func pageSlice(infos []*ObjectInfo, prefix, delimiter string, pageSize int, pageToken string) (*ObjectPage, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	//names sharing a common prefix are adjacent, so collapsing them keeps the entries in order
+	var entries []listEntry
+	for _, info := range infos {
+		if i := strings.Index(info.Name[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			dir := info.Name[:len(prefix)+i+len(delimiter)]
+			if len(entries) == 0 || entries[len(entries)-1].name != dir {
+				entries = append(entries, listEntry{name: dir})
+			}
+			continue
+		}
+
+		entries = append(entries, listEntry{name: info.Name, info: info})
+	}
+
+	if pageToken != "" {
+		after, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil || len(after) == 0 {
+			return nil, ErrInvalidPageToken
+		}
+
+		entries = entries[sort.Search(len(entries), func(i int) bool { return entries[i].name > string(after) }):]
+	}
+
+	page := &ObjectPage{}
+	if len(entries) > pageSize {
+		entries = entries[:pageSize]
+		page.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(entries[pageSize-1].name))
+	}
+
+	for _, e := range entries {
+		if e.info == nil {
+			page.Prefixes = append(page.Prefixes, e.name)
+			continue
+		}
+		page.Objects = append(page.Objects, e.info)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,474 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// MemMgr is an in-memory implementation of ObjectStore, intended for use in tests
+type MemMgr struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string]*memObject
+	gen     int64
+}
+
+// memObject is a single object held by MemMgr
+type memObject struct {
+	data []byte
+	info ObjectInfo
+}
+
+// NewMemMgr returns a new in-memory storage manager. Buckets are created implicitly on first write
+func NewMemMgr() *MemMgr {
+	return &MemMgr{
+		buckets: make(map[string]map[string]*memObject),
+		gen:     time.Now().UnixMicro(),
+	}
+}
+
+// GetBucketFileData returns a byte array for a bucket file
+func (mem *MemMgr) GetBucketFileData(ctx context.Context, bucketName string, fileName string) ([]byte, error) {
+	rc, err := mem.GetBucketFileReader(ctx, bucketName, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// GetBucketFileReader returns a reader for a bucket file, which the caller must close. Reads fail once the context is done
+func (mem *MemMgr) GetBucketFileReader(ctx context.Context, bucketName string, fileName string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	obj, ok := mem.buckets[bucketName][fileName]
+	if !ok {
+		return nil, classify(storage.ErrObjectNotExist)
+	}
+
+	//object data is replaced rather than modified on write, so it can be read without a copy
+	return &ctxReader{ctx: ctx, rc: io.NopCloser(bytes.NewReader(obj.data))}, nil
+}
+
+// Stat returns the attributes of a bucket file without reading its data, failing with ErrNotFound if there is no
+// such file
+func (mem *MemMgr) Stat(ctx context.Context, bucketName string, fileName string) (*ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	obj, ok := mem.buckets[bucketName][fileName]
+	if !ok {
+		return nil, classify(storage.ErrObjectNotExist)
+	}
+
+	return obj.infoCopy(), nil
+}
+
+// GetBucketFileRange returns a reader for length bytes of a bucket file starting at offset, which the caller must close.
+// A negative offset counts back from the end of the object and must be used with a negative length, which reads to the end
+func (mem *MemMgr) GetBucketFileRange(ctx context.Context, bucketName string, fileName string, offset, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	obj, ok := mem.buckets[bucketName][fileName]
+	if !ok {
+		return nil, classify(storage.ErrObjectNotExist)
+	}
+
+	start, length, err := rangeBounds(obj.info.Size, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	data := obj.data[start:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+
+	return &ctxReader{ctx: ctx, rc: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+// StreamBucketFile copies a bucket file into w, returning the number of bytes copied
+func (mem *MemMgr) StreamBucketFile(ctx context.Context, bucketName string, fileName string, w io.Writer) (int64, error) {
+	return streamBucketFile(ctx, mem, bucketName, fileName, w)
+}
+
+// WriteBucketFile writes a file byte array to a bucket file
+func (mem *MemMgr) WriteBucketFile(ctx context.Context, bucketName string, fileName string, data []byte) error {
+	_, err := mem.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), nil)
+	return err
+}
+
+// WriteBucketFileData writes a file byte array to a bucket file, returning the object attributes once the write has been committed
+func (mem *MemMgr) WriteBucketFileData(ctx context.Context, bucketName string, fileName string, data []byte) (*ObjectInfo, error) {
+	return mem.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), nil)
+}
+
+// WriteBucketFileFrom streams the contents of r into a bucket file, returning the object attributes once the write has been committed
+func (mem *MemMgr) WriteBucketFileFrom(ctx context.Context, bucketName string, fileName string, r io.Reader, opts *WriteOptions) (*ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := opts.conditions().validate(false); err != nil {
+		return nil, err
+	}
+
+	contentType, r := opts.contentType(r)
+
+	oh := newObjectHasher()
+	data, err := io.ReadAll(io.TeeReader(&ctxReader{ctx: ctx, rc: io.NopCloser(r)}, oh))
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &memObject{
+		data: data,
+		info: ObjectInfo{
+			Bucket:         bucketName,
+			Name:           fileName,
+			ContentType:    contentType,
+			Metageneration: 1,
+		},
+	}
+	oh.fill(&obj.info)
+
+	if opts != nil {
+		obj.info.ContentEncoding = opts.ContentEncoding
+		obj.info.Metadata = maps.Clone(opts.Metadata)
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	bkt, ok := mem.buckets[bucketName]
+	if !ok {
+		bkt = make(map[string]*memObject)
+		mem.buckets[bucketName] = bkt
+	}
+
+	var cur *ObjectInfo
+	if old, ok := bkt[fileName]; ok {
+		cur = &old.info
+	}
+
+	if err := opts.conditions().check(cur); err != nil {
+		return nil, err
+	}
+
+	//each write creates a new generation of the object
+	mem.gen++
+	obj.info.Generation = mem.gen
+	obj.info.ETag = strconv.FormatInt(mem.gen, 10)
+	obj.info.Created = time.Now().UTC()
+	obj.info.Updated = obj.info.Created
+
+	bkt[fileName] = obj
+
+	return obj.infoCopy(), nil
+}
+
+// WriteBucketFileIf writes a file byte array to a bucket file if the existing object meets the conditions, returning the
+// object attributes once the write has been committed. Unmet conditions fail with ErrPreconditionFailed
+func (mem *MemMgr) WriteBucketFileIf(ctx context.Context, bucketName string, fileName string, data []byte, cond *Conditions) (*ObjectInfo, error) {
+	return mem.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), &WriteOptions{Conditions: cond})
+}
+
+// Copy copies a bucket file to another name, which may be in another bucket
+func (mem *MemMgr) Copy(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	return mem.copy(srcBucket, srcName, dstBucket, dstName)
+}
+
+// Move moves a bucket file to another name, which may be in another bucket. The copy and delete are made under the
+// lock, so the original cannot change in between
+func (mem *MemMgr) Move(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	//moving an object onto itself would delete it
+	if srcBucket == dstBucket && srcName == dstName {
+		return mem.Stat(ctx, srcBucket, srcName)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	info, err := mem.copy(srcBucket, srcName, dstBucket, dstName)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(mem.buckets[srcBucket], srcName)
+
+	return info, nil
+}
+
+// copy copies an object as a new generation of the destination, and must be called with the lock held
+func (mem *MemMgr) copy(srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	src, ok := mem.buckets[srcBucket][srcName]
+	if !ok {
+		return nil, classify(storage.ErrObjectNotExist)
+	}
+
+	bkt, ok := mem.buckets[dstBucket]
+	if !ok {
+		bkt = make(map[string]*memObject)
+		mem.buckets[dstBucket] = bkt
+	}
+
+	//object data is never modified in place, so the copy can share it
+	obj := &memObject{data: src.data, info: src.info}
+	obj.info.Bucket = dstBucket
+	obj.info.Name = dstName
+	obj.info.Metadata = maps.Clone(src.info.Metadata)
+
+	mem.gen++
+	obj.info.Generation = mem.gen
+	obj.info.Metageneration = 1
+	obj.info.ETag = strconv.FormatInt(mem.gen, 10)
+	obj.info.Created = time.Now().UTC()
+	obj.info.Updated = obj.info.Created
+
+	bkt[dstName] = obj
+
+	return obj.infoCopy(), nil
+}
+
+// Compose concatenates the source objects into the destination, in order, in rounds of 32 as GCS does
+func (mem *MemMgr) Compose(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	return composeObjects(ctx, mem, gcsComposeLimit, bucketName, dstName, srcNames, opts)
+}
+
+// composeOnce concatenates the source objects into the destination
+func (mem *MemMgr) composeOnce(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	var data []byte
+
+	mem.mu.RLock()
+	for _, name := range srcNames {
+		obj, ok := mem.buckets[bucketName][name]
+		if !ok {
+			mem.mu.RUnlock()
+			return nil, classify(storage.ErrObjectNotExist)
+		}
+		data = append(data, obj.data...)
+	}
+	mem.mu.RUnlock()
+
+	return mem.WriteBucketFileFrom(ctx, bucketName, dstName, bytes.NewReader(data), composeWriteOptions(opts))
+}
+
+// removeVersion deletes a bucket file if it still has the generation in info
+func (mem *MemMgr) removeVersion(ctx context.Context, bucketName, fileName string, info *ObjectInfo) error {
+	return mem.RemoveFileIf(ctx, bucketName, fileName, &Conditions{GenerationMatch: info.Generation})
+}
+
+// Update replaces the data of a bucket file with the result of fn, retrying if the object changes in the meantime
+func (mem *MemMgr) Update(ctx context.Context, bucketName string, fileName string, fn UpdateFunc) (*ObjectInfo, error) {
+	return updateObject(ctx, fn, func() ([]byte, *ObjectInfo, error) {
+		return mem.readVersion(ctx, bucketName, fileName)
+	}, func(data []byte, cur *ObjectInfo) (*ObjectInfo, error) {
+		return mem.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), updateOptions(cur))
+	})
+}
+
+// readVersion returns the data and attributes of a bucket file, or nil attributes if there is no such file
+func (mem *MemMgr) readVersion(ctx context.Context, bucketName string, fileName string) ([]byte, *ObjectInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	obj, ok := mem.buckets[bucketName][fileName]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	return bytes.Clone(obj.data), obj.infoCopy(), nil
+}
+
+// Objects returns an iterator over the attributes of each object matching the prefix, as they were when it was called
+func (mem *MemMgr) Objects(ctx context.Context, bucketName, prefix string) *ListIterator {
+	return mem.QueryObjects(ctx, bucketName, &ListQuery{Prefix: prefix})
+}
+
+// QueryObjects returns an iterator over the attributes of each object selected by the query, as they were when it was
+// called
+func (mem *MemMgr) QueryObjects(ctx context.Context, bucketName string, q *ListQuery) *ListIterator {
+	var infos []*ObjectInfo
+	for _, obj := range mem.snapshot(bucketName, q.prefix()) {
+		infos = append(infos, obj.infoCopy())
+	}
+
+	return q.apply(sliceIterator(ctx, infos))
+}
+
+// ListPage returns a single page of at most pageSize objects matching the prefix, starting from the page token
+// returned with the previous page. An empty token requests the first page, and a page size of zero or less uses
+// DefaultPageSize
+func (mem *MemMgr) ListPage(ctx context.Context, bucketName, prefix string, pageSize int, pageToken string) (*ObjectPage, error) {
+	return mem.ListDir(ctx, bucketName, prefix, "", pageSize, pageToken)
+}
+
+// ListDir returns a single page of at most pageSize objects and common prefixes, starting from the page token returned
+// with the previous page. Objects whose names contain the delimiter after the prefix are returned as a common prefix
+// rather than individually, which gives a directory-style listing when the delimiter is "/". An empty delimiter lists
+// every object, as ListPage does
+func (mem *MemMgr) ListDir(ctx context.Context, bucketName, prefix, delimiter string, pageSize int, pageToken string) (*ObjectPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var infos []*ObjectInfo
+	for _, obj := range mem.snapshot(bucketName, prefix) {
+		infos = append(infos, obj.infoCopy())
+	}
+
+	return pageSlice(infos, prefix, delimiter, pageSize, pageToken)
+}
+
+// ListObjects returns a configurable buffered channel which contains the attributes of each object matching the prefix
+func (mem *MemMgr) ListObjects(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan ObjectResult, error) {
+	return mem.ListObjectsQuery(ctx, bucketName, &ListQuery{Prefix: prefix}, bufferSize)
+}
+
+// ListObjectsQuery returns a configurable buffered channel which contains the attributes of each object selected by
+// the query
+func (mem *MemMgr) ListObjectsQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan ObjectResult, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	return streamIterator(ctx, mem.QueryObjects(ctx, bucketName, q), bufferSize), nil
+}
+
+// ListObjectsByTime returns a configurable buffered channel which contains the attributes of each object matching the
+// prefix which was created between start and end
+func (mem *MemMgr) ListObjectsByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan ObjectResult, error) {
+	//if the dates are not available, then exit with error
+	if start == nil || end == nil {
+		return nil, ErrMissingDateRange
+	}
+
+	return mem.ListObjectsQuery(ctx, bucketName, createdQuery(prefix, start, end), bufferSize)
+}
+
+// ListBucket returns a configurable buffered channel which contains a subset of object metadata
+func (mem *MemMgr) ListBucket(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan interface{}, error) {
+	return mem.ListBucketQuery(ctx, bucketName, &ListQuery{Prefix: prefix}, bufferSize)
+}
+
+// ListBucketByTime returns a configurable buffered channel which contains a subset of object metadata
+func (mem *MemMgr) ListBucketByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan interface{}, error) {
+	//if the dates are not available, then exit with error
+	if start == nil || end == nil {
+		return nil, ErrMissingDateRange
+	}
+
+	return mem.ListBucketQuery(ctx, bucketName, createdQuery(prefix, start, end), bufferSize)
+}
+
+// ListBucketQuery returns a configurable buffered channel which contains a subset of object metadata for each object
+// selected by the query
+func (mem *MemMgr) ListBucketQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan interface{}, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	return streamAttrs(ctx, mem.QueryObjects(ctx, bucketName, q), bufferSize), nil
+}
+
+// RemoveFile deletes a bucket file
+func (mem *MemMgr) RemoveFile(ctx context.Context, bucketName string, fileName string) error {
+	return mem.RemoveFileIf(ctx, bucketName, fileName, nil)
+}
+
+// RemoveObjects deletes the objects selected by opts with bounded concurrency, and returns a result for each. Objects
+// selected by prefix are only deleted if they are unchanged since they were listed
+func (mem *MemMgr) RemoveObjects(ctx context.Context, bucketName string, opts *RemoveOptions) ([]RemoveResult, error) {
+	return removeObjects(ctx, mem, bucketName, opts)
+}
+
+// RemoveFileIf deletes a bucket file if it meets the conditions. Unmet conditions fail with ErrPreconditionFailed
+func (mem *MemMgr) RemoveFileIf(ctx context.Context, bucketName string, fileName string, cond *Conditions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := cond.validate(true); err != nil {
+		return err
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	obj, ok := mem.buckets[bucketName][fileName]
+	if !ok {
+		return classify(storage.ErrObjectNotExist)
+	}
+
+	if err := cond.check(&obj.info); err != nil {
+		return err
+	}
+
+	delete(mem.buckets[bucketName], fileName)
+
+	return nil
+}
+
+// snapshot returns the objects in a bucket which match the prefix, ordered by name
+func (mem *MemMgr) snapshot(bucketName, prefix string) []*memObject {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	var objs []*memObject
+	for name, obj := range mem.buckets[bucketName] {
+		if strings.HasPrefix(name, prefix) {
+			objs = append(objs, obj)
+		}
+	}
+
+	sort.Slice(objs, func(i, j int) bool { return objs[i].info.Name < objs[j].info.Name })
+
+	return objs
+}
+
+// infoCopy returns a copy of the object attributes which the caller is free to modify
+func (obj *memObject) infoCopy() *ObjectInfo {
+	info := obj.info
+	info.MD5 = bytes.Clone(obj.info.MD5)
+	info.Metadata = maps.Clone(obj.info.Metadata)
+
+	return &info
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func Test_MemWriteReadRemove(t *testing.T) {
+	ctx := context.Background()
+
+	var sto ObjectStore = NewMemMgr()
+
+	//read in the file data
+	dat, err := getLocalFileData(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//write to the test bucket
+	err = sto.WriteBucketFile(ctx, "membucket", testFile, dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//read the data back from the bucket
+	got, err := sto.GetBucketFileData(ctx, "membucket", testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(dat) {
+		t.Fatalf("read %q, want %q", got, dat)
+	}
+
+	//remove the file, then check that it has gone
+	err = sto.RemoveFile(ctx, "membucket", testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sto.GetBucketFileData(ctx, "membucket", testFile)
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("read after remove returned %v, want ErrObjectNotExist", err)
+	}
+
+	err = sto.RemoveFile(ctx, "membucket", testFile)
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("second remove returned %v, want ErrObjectNotExist", err)
+	}
+}
+
+func Test_MemListBucket(t *testing.T) {
+	ctx := context.Background()
+
+	sto := NewMemMgr()
+
+	for _, name := range []string{"b/2.json", "a/1.json", "b/1.json", "c.json"} {
+		if err := sto.WriteBucketFile(ctx, "membucket", name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rfchn, err := sto.ListBucket(ctx, "membucket", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := collectListing(t, rfchn)
+	if len(names) != 4 || names[0] != "a/1.json" || names[3] != "c.json" {
+		t.Fatalf("unexpected listing %v", names)
+	}
+
+	rfchn, err = sto.ListBucket(ctx, "membucket", "b/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names = collectListing(t, rfchn)
+	if len(names) != 2 || names[0] != "b/1.json" || names[1] != "b/2.json" {
+		t.Fatalf("unexpected prefix listing %v", names)
+	}
+}
+
+func Test_MemListPageToken(t *testing.T) {
+	sto := NewMemMgr()
+
+	//tokens which were not issued by ListPage are rejected
+	if _, err := sto.ListPage(context.Background(), "membucket", "", 2, "!!"); err != ErrInvalidPageToken {
+		t.Fatalf("invalid token returned %v, want ErrInvalidPageToken", err)
+	}
+}
+
+func Test_MemListBucketGoroutines(t *testing.T) {
+	sto := NewMemMgr()
+
+	for _, name := range []string{"a.json", "b.json", "c.json"} {
+		if err := sto.WriteBucketFile(context.Background(), "membucket", name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	before := runtime.NumGoroutine()
+
+	//the metadata maps are fed from the listing by a single goroutine
+	rfchn, err := sto.ListBucket(ctx, "membucket", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := runtime.NumGoroutine() - before; n != 1 {
+		t.Fatalf("listing started %d goroutines, want 1", n)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 3 {
+		t.Fatalf("unexpected listing %v", names)
+	}
+
+	waitGoroutines(t, before)
+}
+
+func Test_MemListBucketByTime(t *testing.T) {
+	ctx := context.Background()
+
+	sto := NewMemMgr()
+
+	if err := sto.WriteBucketFile(ctx, "membucket", testFile, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := sto.ListBucketByTime(ctx, "membucket", "", nil, nil, 1)
+	if err != ErrMissingDateRange {
+		t.Fatalf("missing dates returned %v, want ErrMissingDateRange", err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+
+	rfchn, err := sto.ListBucketByTime(ctx, "membucket", "", &start, &end, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 1 {
+		t.Fatalf("unexpected listing %v", names)
+	}
+
+	//a range in the future should match nothing
+	start = time.Now().Add(time.Hour)
+	end = start.Add(time.Hour)
+
+	rfchn, err = sto.ListBucketByTime(ctx, "membucket", "", &start, &end, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 0 {
+		t.Fatalf("unexpected listing %v", names)
+	}
+}
+
+func Test_MemWriteBucketFileData(t *testing.T) {
+	ctx := context.Background()
+
+	sto := NewMemMgr()
+
+	info1, err := sto.WriteBucketFileData(ctx, "membucket", testFile, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info2, err := sto.WriteBucketFileData(ctx, "membucket", testFile, []byte("{ }"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//each write creates a new generation
+	if info2.Generation <= info1.Generation || info2.Size != 3 {
+		t.Fatalf("unexpected attributes %+v after %+v", info2, info1)
+	}
+}
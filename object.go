@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/md5"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	//DefaultChunkSize is the upload chunk size used when WriteOptions.ChunkSize is zero
+	DefaultChunkSize = 16 << 20
+)
+
+// ObjectInfo holds the attributes of a stored object
+type ObjectInfo struct {
+	//Bucket is the bucket holding the object
+	Bucket string
+	//Name is the object name
+	Name string
+	//Size is the object size in bytes
+	Size int64
+	//ContentType is the content type
+	ContentType string
+	//ContentEncoding is the content encoding
+	ContentEncoding string
+	//Owner is the object owner, if the backend reports one
+	Owner string
+	//Created is the time the object was created
+	Created time.Time
+	//Updated is the time the object metadata was last changed
+	Updated time.Time
+	//Generation is the object version, which changes each time the object is written
+	Generation int64
+	//Metageneration is the metadata version, which changes each time the object metadata is updated
+	Metageneration int64
+	//MD5 is the MD5 hash of the object data, if known
+	MD5 []byte
+	//CRC32C is the CRC32 checksum of the object data, using the Castagnoli polynomial
+	CRC32C uint32
+	//ETag is the HTTP entity tag
+	ETag string
+	//Metadata holds the custom metadata
+	Metadata map[string]string
+}
+
+// ObjectResult is a single listing result, which holds either the attributes of an object or the error which ended
+// the listing
+type ObjectResult struct {
+	//Object holds the object attributes
+	Object *ObjectInfo
+	//Err is the listing error, after which no more results are sent
+	Err error
+}
+
+// WriteOptions controls a streaming write
+type WriteOptions struct {
+	//ChunkSize is the number of bytes sent in each upload request. Zero uses DefaultChunkSize, and a negative value
+	//sends the whole object in a single unbuffered request where the backend allows it
+	ChunkSize int
+	//ContentType is the content type, which is detected from the data if empty
+	ContentType string
+	//ContentEncoding is the content encoding, e.g. gzip
+	ContentEncoding string
+	//Metadata holds custom metadata to store with the object
+	Metadata map[string]string
+	//Conditions are preconditions on the existing object, which must be met for the write to succeed
+	Conditions *Conditions
+}
+
+// Conditions are preconditions on the current state of an object, which a conditional write or delete must meet. A
+// write or delete whose conditions are not met fails with ErrPreconditionFailed, and zero fields are not checked
+type Conditions struct {
+	//GenerationMatch requires the object to exist with this generation
+	GenerationMatch int64
+	//MetagenerationMatch requires the object to exist with this metageneration
+	MetagenerationMatch int64
+	//DoesNotExist requires that there is no such object, and can only be used for writes
+	DoesNotExist bool
+}
+
+// crc32cTable is the Castagnoli table used for object checksums
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkSize returns the upload chunk size for the options
+func (opts *WriteOptions) chunkSize() int {
+	if opts == nil || opts.ChunkSize == 0 {
+		return DefaultChunkSize
+	}
+
+	return opts.ChunkSize
+}
+
+// conditions returns the write conditions for the options
+func (opts *WriteOptions) conditions() *Conditions {
+	if opts == nil {
+		return nil
+	}
+
+	return opts.Conditions
+}
+
+// validate checks that the conditions can be met, for a delete if del is set
+func (c *Conditions) validate(del bool) error {
+	if c == nil || !c.DoesNotExist {
+		return nil
+	}
+
+	if del || c.GenerationMatch != 0 || c.MetagenerationMatch != 0 {
+		return ErrInvalidConditions
+	}
+
+	return nil
+}
+
+// check returns ErrPreconditionFailed unless the conditions are met by the existing object, where info is nil if there
+// is no such object
+func (c *Conditions) check(info *ObjectInfo) error {
+	switch {
+	case c == nil:
+		return nil
+	case c.DoesNotExist && info != nil:
+		return ErrPreconditionFailed
+	case c.GenerationMatch != 0 && (info == nil || info.Generation != c.GenerationMatch):
+		return ErrPreconditionFailed
+	case c.MetagenerationMatch != 0 && (info == nil || info.Metageneration != c.MetagenerationMatch):
+		return ErrPreconditionFailed
+	}
+
+	return nil
+}
+
+// gcs returns the equivalent GCS conditions, and whether there are any
+func (c *Conditions) gcs() (storage.Conditions, bool) {
+	if c == nil {
+		return storage.Conditions{}, false
+	}
+
+	gc := storage.Conditions{
+		GenerationMatch:     c.GenerationMatch,
+		MetagenerationMatch: c.MetagenerationMatch,
+		DoesNotExist:        c.DoesNotExist,
+	}
+
+	return gc, gc != storage.Conditions{}
+}
+
+// contentType returns the content type for the options, detecting it from the head of r if none was given. The returned
+// reader must be used in place of r
+func (opts *WriteOptions) contentType(r io.Reader) (string, io.Reader) {
+	if opts != nil && opts.ContentType != "" {
+		return opts.ContentType, r
+	}
+
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+
+	return http.DetectContentType(head), br
+}
+
+// objectHasher computes the MD5 and CRC32C checksums of data as it is written
+type objectHasher struct {
+	md5  hash.Hash
+	crc  hash.Hash32
+	size int64
+}
+
+// newObjectHasher returns a new checksum writer
+func newObjectHasher() *objectHasher {
+	return &objectHasher{
+		md5: md5.New(),
+		crc: crc32.New(crc32cTable),
+	}
+}
+
+// Write adds p to the checksums
+func (oh *objectHasher) Write(p []byte) (int, error) {
+	oh.md5.Write(p)
+	oh.crc.Write(p)
+	oh.size += int64(len(p))
+
+	return len(p), nil
+}
+
+// fill copies the checksums and size into info
+func (oh *objectHasher) fill(info *ObjectInfo) {
+	info.Size = oh.size
+	info.MD5 = oh.md5.Sum(nil)
+	info.CRC32C = oh.crc.Sum32()
+}
+
+// objectInfoFromAttrs converts GCS object attributes into an ObjectInfo
+func objectInfoFromAttrs(attrs *storage.ObjectAttrs) *ObjectInfo {
+	if attrs == nil {
+		return nil
+	}
+
+	return &ObjectInfo{
+		Bucket:          attrs.Bucket,
+		Name:            attrs.Name,
+		Size:            attrs.Size,
+		ContentType:     attrs.ContentType,
+		ContentEncoding: attrs.ContentEncoding,
+		Owner:           attrs.Owner,
+		Created:         attrs.Created,
+		Updated:         attrs.Updated,
+		Generation:      attrs.Generation,
+		Metageneration:  attrs.Metageneration,
+		MD5:             attrs.MD5,
+		CRC32C:          attrs.CRC32C,
+		ETag:            attrs.Etag,
+		Metadata:        attrs.Metadata,
+	}
+}
+
+// attrs returns the object metadata subset sent on the ListBucket channels
+func (info *ObjectInfo) attrs() map[string]interface{} {
+	at := make(map[string]interface{})
+
+	at[ObjAttrName] = info.Name
+	at[ObjAttrContentType] = info.ContentType
+	at[ObjAttrOwner] = info.Owner
+	at[ObjAttrSize] = info.Size
+	at[ObjAttrContentEncoding] = info.ContentEncoding
+	at[ObjAttrCreated] = info.Created.Unix()
+
+	return at
+}
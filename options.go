@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+
+	lbcf "github.com/lidstromberg/config"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// Option configures a storage manager created by NewMgrWithOptions
+type Option func(*mgrConfig) error
+
+// mgrConfig holds the settings collected from the Options
+type mgrConfig struct {
+	bc         lbcf.ConfigSetting
+	debugOn    bool
+	poolSize   int
+	userAgent  string
+	retry      []storage.RetryOption
+	clientOpts []option.ClientOption
+}
+
+// WithPoolSize sets the size of the client connection pool
+func WithPoolSize(size int) Option {
+	return func(cfg *mgrConfig) error {
+		if size < 1 {
+			return ErrInvalidPoolSize
+		}
+
+		cfg.poolSize = size
+		return nil
+	}
+}
+
+// WithDebug switches verbose logging on or off
+func WithDebug(debugOn bool) Option {
+	return func(cfg *mgrConfig) error {
+		cfg.debugOn = debugOn
+		return nil
+	}
+}
+
+// WithCredentialsJSON authenticates with a GCP credential supplied as a byte array
+func WithCredentialsJSON(cred []byte) Option {
+	return func(cfg *mgrConfig) error {
+		cfg.clientOpts = append(cfg.clientOpts, option.WithCredentialsJSON(cred))
+		return nil
+	}
+}
+
+// WithCredentialsFile authenticates with a GCP credential file
+func WithCredentialsFile(path string) Option {
+	return func(cfg *mgrConfig) error {
+		cfg.clientOpts = append(cfg.clientOpts, option.WithCredentialsFile(path))
+		return nil
+	}
+}
+
+// WithEndpoint points the client at a custom endpoint URL, such as a GCS emulator
+func WithEndpoint(endpoint string) Option {
+	return func(cfg *mgrConfig) error {
+		if endpoint == "" {
+			return ErrMissingEndpoint
+		}
+
+		cfg.clientOpts = append(cfg.clientOpts, EndpointOption(endpoint))
+		return nil
+	}
+}
+
+// WithoutAuthentication switches off authentication, as required by most GCS emulators
+func WithoutAuthentication() Option {
+	return func(cfg *mgrConfig) error {
+		cfg.clientOpts = append(cfg.clientOpts, option.WithoutAuthentication())
+		return nil
+	}
+}
+
+// WithUserAgent sets the user agent sent with each request
+func WithUserAgent(userAgent string) Option {
+	return func(cfg *mgrConfig) error {
+		cfg.userAgent = userAgent
+		return nil
+	}
+}
+
+// WithRetry sets the retry policy applied to every operation, e.g. storage.WithPolicy(storage.RetryAlways)
+func WithRetry(opts ...storage.RetryOption) Option {
+	return func(cfg *mgrConfig) error {
+		cfg.retry = append(cfg.retry, opts...)
+		return nil
+	}
+}
+
+// WithClientOptions passes further options to the GCS client
+func WithClientOptions(opts ...option.ClientOption) Option {
+	return func(cfg *mgrConfig) error {
+		cfg.clientOpts = append(cfg.clientOpts, opts...)
+		return nil
+	}
+}
+
+// WithEnvConfig loads the debug and pool size settings from the STOR_DEBUGON and STOR_CLIPOOL environment variables,
+// as NewMgr does, but returns an error rather than exiting if they are missing. A nil bc loads them into a new config
+func WithEnvConfig(ctx context.Context, bc lbcf.ConfigSetting) Option {
+	return func(cfg *mgrConfig) error {
+		cb := bc
+		if cb == nil {
+			cb = lbcf.NewConfig(ctx)
+		}
+
+		debugOn, poolSize, err := loadEnvConfig(ctx, cb)
+		if err != nil {
+			return err
+		}
+
+		cfg.bc = cb
+		cfg.debugOn = debugOn
+		cfg.poolSize = poolSize
+		return nil
+	}
+}
+
+// clientOptions returns the GCS client options for the config
+func (cfg *mgrConfig) clientOptions() []option.ClientOption {
+	var opts []option.ClientOption
+
+	if cfg.poolSize > 0 {
+		opts = append(opts, option.WithGRPCConnectionPool(cfg.poolSize))
+	}
+
+	if cfg.userAgent != "" {
+		opts = append(opts, option.WithUserAgent(cfg.userAgent))
+	}
+
+	return append(opts, cfg.clientOpts...)
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	lbcf "github.com/lidstromberg/config"
+
+	"cloud.google.com/go/storage"
+)
+
+func Test_NewMgrWithOptions(t *testing.T) {
+	ctx := context.Background()
+
+	_, endpoint := newGCSFake(t, "gcsbucket")
+
+	//create a new storage object without any environment variables
+	sto, err := NewMgrWithOptions(ctx,
+		WithPoolSize(2),
+		WithDebug(false),
+		WithEndpoint(endpoint),
+		WithoutAuthentication(),
+		WithUserAgent("storage-test"),
+		WithRetry(storage.WithPolicy(storage.RetryAlways)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sto.WriteBucketFile(ctx, "gcsbucket", testFile, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sto.GetBucketFileData(ctx, "gcsbucket", testFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_NewMgrWithOptionsErrors(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := NewMgrWithOptions(ctx, WithPoolSize(0)); err != ErrInvalidPoolSize {
+		t.Fatalf("zero pool size returned %v, want ErrInvalidPoolSize", err)
+	}
+
+	if _, err := NewMgrWithOptions(ctx, WithEndpoint("")); err != ErrMissingEndpoint {
+		t.Fatalf("empty endpoint returned %v, want ErrMissingEndpoint", err)
+	}
+
+	//missing environment variables should be reported rather than exiting
+	t.Setenv("STOR_DEBUGON", "")
+	t.Setenv("STOR_CLIPOOL", "5")
+
+	if _, err := NewMgrWithOptions(ctx, WithEnvConfig(ctx, lbcf.NewConfig(ctx))); err != ErrInvalidDebugOn {
+		t.Fatalf("missing STOR_DEBUGON returned %v, want ErrInvalidDebugOn", err)
+	}
+
+	t.Setenv("STOR_DEBUGON", "false")
+	t.Setenv("STOR_CLIPOOL", "many")
+
+	if _, err := NewMgrWithOptions(ctx, WithEnvConfig(ctx, lbcf.NewConfig(ctx))); err != ErrInvalidClientPool {
+		t.Fatalf("bad STOR_CLIPOOL returned %v, want ErrInvalidClientPool", err)
+	}
+}
+
+func Test_WithEnvConfig(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("STOR_DEBUGON", "true")
+	t.Setenv("STOR_CLIPOOL", "3")
+
+	cfg := &mgrConfig{}
+	if err := WithEnvConfig(ctx, lbcf.NewConfig(ctx))(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !cfg.debugOn || cfg.poolSize != 3 {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	//a nil config is replaced rather than dereferenced
+	cfg = &mgrConfig{}
+	if err := WithEnvConfig(ctx, nil)(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.bc == nil || !cfg.debugOn || cfg.poolSize != 3 {
+		t.Fatalf("unexpected config from nil %+v", cfg)
+	}
+}
+
+func Test_PerManagerConfig(t *testing.T) {
+	ctx := context.Background()
+
+	EnvDebugOn = false
+
+	//two managers with different settings should not affect each other, or the package values
+	sto1, err := NewMgrWithOptions(ctx, WithDebug(true), WithPoolSize(2), WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sto2, err := NewMgrWithOptions(ctx, WithDebug(false), WithPoolSize(7), WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sto1.DebugOn() || sto1.PoolSize() != 2 {
+		t.Fatalf("first manager has debug %v and pool %d", sto1.DebugOn(), sto1.PoolSize())
+	}
+
+	if sto2.DebugOn() || sto2.PoolSize() != 7 {
+		t.Fatalf("second manager has debug %v and pool %d", sto2.DebugOn(), sto2.PoolSize())
+	}
+
+	if EnvDebugOn {
+		t.Fatal("NewMgrWithOptions changed EnvDebugOn")
+	}
+}
+
+func Test_PerManagerConcurrentNewMgr(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("STOR_DEBUGON", "true")
+	t.Setenv("STOR_CLIPOOL", "4")
+
+	EnvDebugOn, EnvClientPool = false, 0
+
+	//managers created side by side load their own settings, and leave the package values alone
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sto, err := NewMgr(ctx, lbcf.NewConfig(ctx), EmulatorOptions("http://127.0.0.1:1")...)
+			if err == nil && (!sto.DebugOn() || sto.PoolSize() != 4) {
+				err = fmt.Errorf("manager has debug %v and pool %d", sto.DebugOn(), sto.PoolSize())
+			}
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if EnvDebugOn || EnvClientPool != 0 {
+		t.Fatalf("NewMgr set the package values to %v and %d", EnvDebugOn, EnvClientPool)
+	}
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TimeRange selects objects whose timestamp falls between Start and End. A zero Start or End leaves that end of the
+// range open, and each bound is exclusive unless IncludeStart or IncludeEnd is set
+type TimeRange struct {
+	//Start is the beginning of the range
+	Start time.Time
+	//End is the end of the range
+	End time.Time
+	//IncludeStart includes objects whose timestamp equals Start
+	IncludeStart bool
+	//IncludeEnd includes objects whose timestamp equals End
+	IncludeEnd bool
+}
+
+// ListQuery selects the objects returned by the query listings. Name conditions are passed to the backend where it
+// can filter on them, and every other condition is checked as the listing is read. An object must satisfy every
+// condition which is set
+type ListQuery struct {
+	//Prefix restricts the listing to names beginning with it
+	Prefix string
+	//StartOffset restricts the listing to names which sort at or after it
+	StartOffset string
+	//EndOffset restricts the listing to names which sort before it
+	EndOffset string
+	//Created restricts the listing to objects created within the range
+	Created *TimeRange
+	//Updated restricts the listing to objects last updated within the range
+	Updated *TimeRange
+	//MatchGlob restricts the listing to names matching the glob pattern, using the GCS syntax: * matches any
+	//characters other than /, ** matches any characters, ? matches a single character other than /, [abc] and [!abc]
+	//match character classes, and {a,b} matches either alternative
+	MatchGlob string
+	//Regexp restricts the listing to names which it matches
+	Regexp *regexp.Regexp
+	//Filter restricts the listing to objects for which it returns true
+	Filter func(*ObjectInfo) bool
+}
+
+// contains reports whether t falls within the range, where a nil range contains every time
+func (tr *TimeRange) contains(t time.Time) bool {
+	if tr == nil {
+		return true
+	}
+
+	if !tr.Start.IsZero() && (t.Before(tr.Start) || (!tr.IncludeStart && t.Equal(tr.Start))) {
+		return false
+	}
+
+	if !tr.End.IsZero() && (t.After(tr.End) || (!tr.IncludeEnd && t.Equal(tr.End))) {
+		return false
+	}
+
+	return true
+}
+
+// prefix returns the query prefix, where a nil query lists every object
+func (q *ListQuery) prefix() string {
+	if q == nil {
+		return ""
+	}
+
+	return q.Prefix
+}
+
+// matcher returns a function which reports whether an object satisfies the query, failing with ErrInvalidGlob if the
+// glob pattern cannot be compiled. Conditions which the backend has already applied are checked again, which costs
+// little and covers backends which ignore them
+func (q *ListQuery) matcher() (func(*ObjectInfo) bool, error) {
+	if q == nil {
+		return nil, nil
+	}
+
+	var glob *regexp.Regexp
+	if q.MatchGlob != "" {
+		var err error
+		if glob, err = globRegexp(q.MatchGlob); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(info *ObjectInfo) bool {
+		switch {
+		case info.Name < q.StartOffset, q.EndOffset != "" && info.Name >= q.EndOffset:
+			return false
+		case !q.Created.contains(info.Created), !q.Updated.contains(info.Updated):
+			return false
+		case glob != nil && !glob.MatchString(info.Name), q.Regexp != nil && !q.Regexp.MatchString(info.Name):
+			return false
+		case q.Filter != nil && !q.Filter(info):
+			return false
+		}
+
+		return true
+	}, nil
+}
+
+// apply sets the query conditions on an iterator over a listing ordered by name, which then stops at EndOffset
+// rather than reading the remainder of the listing. An invalid query fails the iterator
+func (q *ListQuery) apply(it *ListIterator) *ListIterator {
+	if q == nil {
+		return it
+	}
+
+	keep, err := q.matcher()
+	if err != nil {
+		it.err = err
+		return it
+	}
+
+	it.keep = keep
+	it.end = q.EndOffset
+
+	return it
+}
+
+// withoutGlob returns a copy of the query without its glob pattern, for backends which have matched it already. An
+// invalid pattern is kept so that the listing still fails with ErrInvalidGlob
+func (q *ListQuery) withoutGlob() *ListQuery {
+	if q == nil || q.MatchGlob == "" {
+		return q
+	}
+
+	if _, err := globRegexp(q.MatchGlob); err != nil {
+		return q
+	}
+
+	qc := *q
+	qc.MatchGlob = ""
+
+	return &qc
+}
+
+// validate reports whether the query can be used, for listings which return errors before they start
+func (q *ListQuery) validate() error {
+	_, err := q.matcher()
+	return err
+}
+
+// globRegexp compiles a GCS glob pattern into an anchored regular expression
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+
+	alts := 0
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			//a ] straight after the opening bracket or negation is part of the class
+			j := i + 1
+			if j < len(pattern) && pattern[j] == '!' {
+				j++
+			}
+			if j < len(pattern) && pattern[j] == ']' {
+				j++
+			}
+			end := strings.IndexByte(pattern[j:], ']')
+			if end < 0 {
+				return nil, ErrInvalidGlob
+			}
+
+			class := pattern[i+1 : j+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = j + end
+		case '{':
+			sb.WriteString("(?:")
+			alts++
+		case ',':
+			if alts > 0 {
+				sb.WriteString("|")
+			} else {
+				sb.WriteString(",")
+			}
+		case '}':
+			if alts == 0 {
+				return nil, ErrInvalidGlob
+			}
+			sb.WriteString(")")
+			alts--
+		case '\\':
+			//a backslash matches the following character literally
+			if i+1 < len(pattern) {
+				i++
+			}
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if alts > 0 {
+		return nil, ErrInvalidGlob
+	}
+
+	sb.WriteString("$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, ErrInvalidGlob
+	}
+
+	return re, nil
+}
+
+// createdQuery returns the query used by the ListBucketByTime methods, which select objects created strictly between
+// start and end
+func createdQuery(prefix string, start, end *time.Time) *ListQuery {
+	return &ListQuery{
+		Prefix:  prefix,
+		Created: &TimeRange{Start: *start, End: *end},
+	}
+}
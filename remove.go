@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	//DefaultRemoveConcurrency is the number of deletes made at once when RemoveOptions.Concurrency is zero
+	DefaultRemoveConcurrency = 16
+)
+
+// RemoveOptions selects the objects deleted by RemoveObjects
+type RemoveOptions struct {
+	//Names lists the objects to delete
+	Names []string
+	//Prefix selects every object whose name has the prefix, and is only used if Names is empty
+	Prefix string
+	//Start and End, if both are set, only select objects created strictly between them, as ListBucketByTime does
+	Start *time.Time
+	End   *time.Time
+	//Concurrency is the largest number of deletes in flight at once. Zero uses DefaultRemoveConcurrency
+	Concurrency int
+	//DryRun reports the objects which would be deleted, without deleting them
+	DryRun bool
+}
+
+// RemoveResult reports what happened to a single object
+type RemoveResult struct {
+	//Name is the object name
+	Name string
+	//Object holds the object attributes, if they were read
+	Object *ObjectInfo
+	//Deleted is set once the object has been deleted, and is never set by a dry run
+	Deleted bool
+	//Err is the error which stopped the object being deleted
+	Err error
+}
+
+// remover is implemented by the backends to delete objects in bulk
+type remover interface {
+	Stat(ctx context.Context, bucketName string, fileName string) (*ObjectInfo, error)
+	QueryObjects(ctx context.Context, bucketName string, q *ListQuery) *ListIterator
+	RemoveFile(ctx context.Context, bucketName string, fileName string) error
+	removeVersion(ctx context.Context, bucketName, fileName string, info *ObjectInfo) error
+}
+
+// concurrency returns the number of deletes to make at once
+func (opts *RemoveOptions) concurrency() int {
+	if opts.Concurrency <= 0 {
+		return DefaultRemoveConcurrency
+	}
+
+	return opts.Concurrency
+}
+
+// created returns the creation time range which objects must fall in, or nil if there is none
+func (opts *RemoveOptions) created() *TimeRange {
+	if opts.Start == nil {
+		return nil
+	}
+
+	return &TimeRange{Start: *opts.Start, End: *opts.End}
+}
+
+// lookupObject returns the attributes of a named object. If listed is set they are taken from a listing, as the time
+// filters are applied to the timestamps which a listing reports, and S3 only gives whole seconds when an object is read
+func lookupObject(ctx context.Context, r remover, bucketName, fileName string, listed bool) (*ObjectInfo, error) {
+	if !listed {
+		return r.Stat(ctx, bucketName, fileName)
+	}
+
+	//the offsets select the name alone, where the backend can filter on them
+	q := &ListQuery{Prefix: fileName, StartOffset: fileName, EndOffset: fileName + "\x00"}
+
+	for info, err := range r.QueryObjects(ctx, bucketName, q).All() {
+		if err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+
+	//stat reports the backend's own error for a missing object
+	return r.Stat(ctx, bucketName, fileName)
+}
+
+// removeObjects deletes the objects selected by opts, returning a result for each in the order of the names or the
+// listing. Objects found by listing are only deleted if they have not changed since they were listed, so that newer
+// data written under the same name is kept
+func removeObjects(ctx context.Context, r remover, bucketName string, opts *RemoveOptions) ([]RemoveResult, error) {
+	//deleting every object in a bucket must be asked for with an explicit prefix
+	if opts == nil || (len(opts.Names) == 0 && opts.Prefix == "") {
+		return nil, ErrMissingObjects
+	}
+
+	if (opts.Start == nil) != (opts.End == nil) {
+		return nil, ErrMissingDateRange
+	}
+
+	created := opts.created()
+
+	var results []RemoveResult
+
+	if len(opts.Names) > 0 {
+		results = make([]RemoveResult, len(opts.Names))
+		for i, name := range opts.Names {
+			results[i].Name = name
+		}
+	} else {
+		q := &ListQuery{Prefix: opts.Prefix, Created: created}
+
+		for info, err := range r.QueryObjects(ctx, bucketName, q).All() {
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, RemoveResult{Name: info.Name, Object: info})
+		}
+	}
+
+	//objects which are listed by name are read first if they have to be checked
+	check := len(opts.Names) > 0 && (created != nil || opts.DryRun)
+
+	//skip marks named objects which fall outside the time range, and so are left out of the results
+	skip := make([]bool, len(results))
+
+	sem := make(chan struct{}, opts.concurrency())
+	var wg sync.WaitGroup
+
+	for i := range results {
+		res := &results[i]
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			res.Err = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if check {
+				if res.Object, res.Err = lookupObject(ctx, r, bucketName, res.Name, created != nil); res.Err != nil {
+					return
+				}
+
+				if created != nil && !created.contains(res.Object.Created) {
+					skip[i] = true
+					return
+				}
+			}
+
+			if opts.DryRun {
+				return
+			}
+
+			if res.Object != nil {
+				res.Err = r.removeVersion(ctx, bucketName, res.Name, res.Object)
+			} else {
+				res.Err = r.RemoveFile(ctx, bucketName, res.Name)
+			}
+
+			res.Deleted = res.Err == nil
+		}()
+	}
+
+	wg.Wait()
+
+	kept := results[:0]
+	for i, res := range results {
+		if !skip[i] {
+			kept = append(kept, res)
+		}
+	}
+
+	return kept, nil
+}
@@ -0,0 +1,1152 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	lblog "github.com/lidstromberg/log"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	//s3MinPartSize is the smallest part S3 accepts in a multipart upload, other than the last
+	s3MinPartSize = 5 << 20
+	//s3MaxCopySize is the largest object which CopyObject can copy in a single request
+	s3MaxCopySize = 5 << 30
+	//s3MetaPrefix is the header prefix for custom object metadata
+	s3MetaPrefix = "X-Amz-Meta-"
+)
+
+// S3Config holds the connection settings for an S3-compatible service
+type S3Config struct {
+	//Endpoint is the service URL, e.g. https://s3.eu-west-2.amazonaws.com or http://localhost:9000
+	Endpoint string
+	//Region is the signing region, which defaults to us-east-1
+	Region string
+	//AccessKeyID is the access key
+	AccessKeyID string
+	//SecretAccessKey is the secret key
+	SecretAccessKey string
+	//SessionToken is an optional temporary session token
+	SessionToken string
+	//PathStyle addresses buckets as endpoint/bucket rather than bucket.endpoint, as MinIO requires
+	PathStyle bool
+	//HTTPClient is the client used to make requests, which defaults to http.DefaultClient
+	HTTPClient *http.Client
+	//ConditionalDeletes declares that the service honours If-Match on DeleteObject, as AWS S3 does but many
+	//S3-compatible services do not. Deletes of missing objects then fail with ErrNotFound, as on GCS, and otherwise they
+	//succeed. Move and Compose with DeleteSources must only remove an unchanged object, so they fail with
+	//ErrUnsupportedCondition unless it is set, while RemoveObjects then deletes the objects it lists without a guard
+	ConditionalDeletes bool
+}
+
+// S3Mgr is an S3-compatible implementation of ObjectStore, using PutObject, GetObject, ListObjectsV2 and DeleteObject
+type S3Mgr struct {
+	endpoint *url.URL
+	client   *http.Client
+	signer   *s3Signer
+	path     bool
+	//conditionalDeletes is set if the service honours If-Match on DeleteObject
+	conditionalDeletes bool
+	//copyPartSize is the size of the parts in which objects too large for a single CopyObject are copied
+	copyPartSize int64
+}
+
+// S3Error is an error response returned by an S3-compatible service
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	Resource   string `xml:"Resource"`
+	RequestID  string `xml:"RequestId"`
+}
+
+// Error returns the S3 error description
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// s3ListResult is the ListObjectsV2 response body
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+		StorageClass string    `xml:"StorageClass"`
+		Owner        struct {
+			ID          string `xml:"ID"`
+			DisplayName string `xml:"DisplayName"`
+		} `xml:"Owner"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// s3InitiateMultipartResult is the CreateMultipartUpload response body
+type s3InitiateMultipartResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// s3CompleteMultipartUpload is the CompleteMultipartUpload request body
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// s3CompletedPart identifies an uploaded part
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3CopyPartResult is the UploadPartCopy response body
+type s3CopyPartResult struct {
+	ETag string `xml:"ETag"`
+}
+
+// NewS3Mgr returns a new storage manager for an S3-compatible service
+func NewS3Mgr(cfg S3Config) (*S3Mgr, error) {
+	if cfg.Endpoint == "" {
+		return nil, ErrMissingEndpoint
+	}
+
+	ep, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if ep.Scheme == "" || ep.Host == "" {
+		return nil, fmt.Errorf("s3 endpoint %q must include a scheme and host", cfg.Endpoint)
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	s3 := &S3Mgr{
+		endpoint: ep,
+		client:   client,
+		path:     cfg.PathStyle,
+		signer: &s3Signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          region,
+		},
+		copyPartSize:       s3MaxCopySize,
+		conditionalDeletes: cfg.ConditionalDeletes,
+	}
+
+	return s3, nil
+}
+
+// GetBucketFileData returns a byte array for a bucket file
+func (s3 *S3Mgr) GetBucketFileData(ctx context.Context, bucketName string, fileName string) ([]byte, error) {
+	resp, err := s3.do(ctx, http.MethodGet, bucketName, fileName, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s3.close(resp, "GetBucketFileData")
+
+	return io.ReadAll(resp.Body)
+}
+
+// GetBucketFileReader returns a reader for a bucket file, which the caller must close. Reads fail once the context is done
+func (s3 *S3Mgr) GetBucketFileReader(ctx context.Context, bucketName string, fileName string) (io.ReadCloser, error) {
+	resp, err := s3.do(ctx, http.MethodGet, bucketName, fileName, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctxReader{ctx: ctx, rc: resp.Body}, nil
+}
+
+// Stat returns the attributes of a bucket file without reading its data, failing with ErrNotFound if there is no
+// such file. The MD5 is taken from the etag of single part uploads, and the CRC32C is only reported for objects which
+// were uploaded with one
+func (s3 *S3Mgr) Stat(ctx context.Context, bucketName string, fileName string) (*ObjectInfo, error) {
+	return s3.head(ctx, bucketName, fileName)
+}
+
+// GetBucketFileRange returns a reader for length bytes of a bucket file starting at offset, which the caller must close.
+// A negative offset counts back from the end of the object and must be used with a negative length, which reads to the end
+func (s3 *S3Mgr) GetBucketFileRange(ctx context.Context, bucketName string, fileName string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 && length >= 0 {
+		return nil, ErrInvalidRange
+	}
+
+	//an empty range still needs the object to exist
+	if length == 0 {
+		if _, err := s3.head(ctx, bucketName, fileName); err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	hdr := make(http.Header)
+	switch {
+	case offset < 0:
+		hdr.Set("Range", fmt.Sprintf("bytes=%d", offset))
+	case length > 0:
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := s3.do(ctx, http.MethodGet, bucketName, fileName, nil, hdr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ctxReader{ctx: ctx, rc: resp.Body}, nil
+}
+
+// StreamBucketFile copies a bucket file into w, returning the number of bytes copied
+func (s3 *S3Mgr) StreamBucketFile(ctx context.Context, bucketName string, fileName string, w io.Writer) (int64, error) {
+	return streamBucketFile(ctx, s3, bucketName, fileName, w)
+}
+
+// WriteBucketFile writes a file byte array to a bucket file
+func (s3 *S3Mgr) WriteBucketFile(ctx context.Context, bucketName string, fileName string, data []byte) error {
+	hdr := make(http.Header)
+	hdr.Set("Content-Type", http.DetectContentType(data))
+
+	resp, err := s3.do(ctx, http.MethodPut, bucketName, fileName, nil, hdr, data)
+	if err != nil {
+		return err
+	}
+	s3.close(resp, "WriteBucketFile")
+
+	return nil
+}
+
+// WriteBucketFileData writes a file byte array to a bucket file, returning the object attributes once the write has been committed
+func (s3 *S3Mgr) WriteBucketFileData(ctx context.Context, bucketName string, fileName string, data []byte) (*ObjectInfo, error) {
+	return s3.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), &WriteOptions{ChunkSize: -1})
+}
+
+// WriteBucketFileFrom streams the contents of r into a bucket file, returning the object attributes once the write has been committed.
+// Objects larger than the chunk size are sent as a multipart upload, in parts of at least 5MiB. A negative chunk size buffers the whole
+// object and sends it with a single PutObject. Metadata keys are returned in lower case, as S3 stores them
+func (s3 *S3Mgr) WriteBucketFileFrom(ctx context.Context, bucketName string, fileName string, r io.Reader, opts *WriteOptions) (*ObjectInfo, error) {
+	condHdr, err := s3Conditions(opts.conditions(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.write(ctx, bucketName, fileName, r, opts, condHdr)
+}
+
+// write streams the contents of r into a bucket file, sending the conditional headers in condHdr with the request
+// which commits the object
+func (s3 *S3Mgr) write(ctx context.Context, bucketName string, fileName string, r io.Reader, opts *WriteOptions, condHdr http.Header) (*ObjectInfo, error) {
+	contentType, r := opts.contentType(r)
+
+	hdr := make(http.Header)
+	hdr.Set("Content-Type", contentType)
+	if opts != nil {
+		if opts.ContentEncoding != "" {
+			hdr.Set("Content-Encoding", opts.ContentEncoding)
+		}
+		for k, v := range opts.Metadata {
+			hdr.Set(s3MetaPrefix+k, v)
+		}
+	}
+
+	oh := newObjectHasher()
+	tr := io.TeeReader(r, oh)
+
+	partSize := max(opts.chunkSize(), s3MinPartSize)
+	if opts.chunkSize() < 0 {
+		partSize = -1
+	}
+
+	//if the first part holds the whole object then a single PutObject will do
+	part, last, err := s3ReadPart(tr, partSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if last {
+		maps.Copy(hdr, condHdr)
+
+		resp, err := s3.do(ctx, http.MethodPut, bucketName, fileName, nil, hdr, part)
+		if err != nil {
+			return nil, err
+		}
+		s3.close(resp, "WriteBucketFileFrom")
+	} else {
+		err := s3.multipartUpload(ctx, bucketName, fileName, hdr, condHdr, func(q url.Values) (string, bool, error) {
+			resp, err := s3.do(ctx, http.MethodPut, bucketName, fileName, q, nil, part)
+			if err != nil {
+				return "", false, err
+			}
+			s3.close(resp, "WriteBucketFileFrom")
+
+			part, _, err = s3ReadPart(tr, partSize)
+
+			return resp.Header.Get("ETag"), len(part) == 0, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := s3.head(ctx, bucketName, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	//S3 only reports an MD5 etag for single part uploads, so use the checksums of the data as it was sent
+	oh.fill(info)
+
+	return info, nil
+}
+
+// WriteBucketFileIf writes a file byte array to a bucket file if the existing object meets the conditions, returning the
+// object attributes once the write has been committed. Unmet conditions fail with ErrPreconditionFailed. S3 objects
+// have no generations, so only DoesNotExist is supported
+func (s3 *S3Mgr) WriteBucketFileIf(ctx context.Context, bucketName string, fileName string, data []byte, cond *Conditions) (*ObjectInfo, error) {
+	return s3.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), &WriteOptions{Conditions: cond})
+}
+
+// Update replaces the data of a bucket file with the result of fn, retrying if its etag changes in the meantime
+func (s3 *S3Mgr) Update(ctx context.Context, bucketName string, fileName string, fn UpdateFunc) (*ObjectInfo, error) {
+	return updateObject(ctx, fn, func() ([]byte, *ObjectInfo, error) {
+		return s3.readVersion(ctx, bucketName, fileName)
+	}, func(data []byte, cur *ObjectInfo) (*ObjectInfo, error) {
+		//S3 objects have no generations, so the etag stands in for one
+		hdr := make(http.Header)
+		if cur == nil {
+			hdr.Set("If-None-Match", "*")
+		} else {
+			hdr.Set("If-Match", cur.ETag)
+		}
+
+		opts := updateOptions(cur)
+		opts.Conditions = nil
+
+		return s3.write(ctx, bucketName, fileName, bytes.NewReader(data), opts, hdr)
+	})
+}
+
+// readVersion returns the data and attributes of a bucket file, or nil attributes if there is no such file
+func (s3 *S3Mgr) readVersion(ctx context.Context, bucketName string, fileName string) ([]byte, *ObjectInfo, error) {
+	//the transport would otherwise ask for gzip and decompress the stored bytes, which are written back with the same
+	//content encoding
+	hdr := make(http.Header)
+	hdr.Set("Accept-Encoding", "identity")
+
+	resp, err := s3.do(ctx, http.MethodGet, bucketName, fileName, nil, hdr, nil)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s3.close(resp, "readVersion")
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, s3ObjectInfo(bucketName, fileName, resp.Header, int64(len(data))), nil
+}
+
+// multipartUpload creates an object from a multipart upload. sendPart is called with the query parameters for each
+// part in turn, and returns the part etag and whether it was the last. The conditions in condHdr are checked when the
+// upload is completed
+func (s3 *S3Mgr) multipartUpload(ctx context.Context, bucketName, fileName string, hdr, condHdr http.Header, sendPart func(q url.Values) (string, bool, error)) error {
+	resp, err := s3.do(ctx, http.MethodPost, bucketName, fileName, url.Values{"uploads": {""}}, hdr, nil)
+	if err != nil {
+		return err
+	}
+
+	initRes := &s3InitiateMultipartResult{}
+	err = xml.NewDecoder(resp.Body).Decode(initRes)
+	s3.close(resp, "WriteBucketFileFrom")
+	if err != nil {
+		return err
+	}
+
+	complete := &s3CompleteMultipartUpload{}
+
+	err = func() error {
+		for n, last := 1, false; !last; n++ {
+			q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {initRes.UploadID}}
+
+			var etag string
+			var err error
+			if etag, last, err = sendPart(q); err != nil {
+				return err
+			}
+
+			complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: n, ETag: etag})
+		}
+
+		body, err := xml.Marshal(complete)
+		if err != nil {
+			return err
+		}
+
+		resp, err := s3.do(ctx, http.MethodPost, bucketName, fileName, url.Values{"uploadId": {initRes.UploadID}}, condHdr, body)
+		if err != nil {
+			return err
+		}
+		defer s3.close(resp, "WriteBucketFileFrom")
+
+		return s3Result(resp, nil)
+	}()
+
+	if err != nil {
+		//abandon the upload, so that the parts are not left behind
+		abortCtx := context.WithoutCancel(ctx)
+		if resp, aerr := s3.do(abortCtx, http.MethodDelete, bucketName, fileName, url.Values{"uploadId": {initRes.UploadID}}, nil, nil); aerr == nil {
+			s3.close(resp, "WriteBucketFileFrom")
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Copy copies a bucket file to another name, which may be in another bucket, without downloading it. Objects larger
+// than CopyObject allows are copied in parts with UploadPartCopy
+func (s3 *S3Mgr) Copy(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	src, err := s3.head(ctx, srcBucket, srcName)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.copy(ctx, srcBucket, srcName, src, dstBucket, dstName)
+}
+
+// Move moves a bucket file to another name, which may be in another bucket, by copying it and then deleting the
+// original. The original is only deleted if it still has the etag which was copied, and otherwise both objects are
+// kept and ErrPreconditionFailed is returned. Without ConditionalDeletes nothing is copied and ErrUnsupportedCondition
+// is returned
+func (s3 *S3Mgr) Move(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	//moving an object onto itself would delete it
+	if srcBucket == dstBucket && srcName == dstName {
+		return s3.Stat(ctx, srcBucket, srcName)
+	}
+
+	if !s3.conditionalDeletes {
+		return nil, ErrUnsupportedCondition
+	}
+
+	src, err := s3.head(ctx, srcBucket, srcName)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s3.copy(ctx, srcBucket, srcName, src, dstBucket, dstName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s3.removeVersion(ctx, srcBucket, srcName, src); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Compose concatenates the source objects into the destination, in order, with a multipart upload. Sources which can
+// be parts of a multipart upload are copied server side, and otherwise the data passes through the client. Up to
+// 10000 objects are composed at a time, so larger composes are made in rounds through temporary objects, which are
+// deleted afterwards. If the destination was written but the temporary objects or sources could not all be deleted,
+// its attributes are returned along with the error. DeleteSources needs ConditionalDeletes, and otherwise nothing is
+// composed and ErrUnsupportedCondition is returned
+func (s3 *S3Mgr) Compose(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	if opts != nil && opts.DeleteSources && !s3.conditionalDeletes {
+		return nil, ErrUnsupportedCondition
+	}
+
+	return composeObjects(ctx, s3, s3ComposeLimit, bucketName, dstName, srcNames, opts)
+}
+
+// composeOnce composes up to 10000 source objects into the destination. UploadPartCopy is used if every source but
+// the last is large enough to be a part, and small enough to be copied in one request
+func (s3 *S3Mgr) composeOnce(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	srcs := make([]*ObjectInfo, len(srcNames))
+	copyable := true
+
+	for i, name := range srcNames {
+		src, err := s3.head(ctx, bucketName, name)
+		if err != nil {
+			return nil, err
+		}
+		srcs[i] = src
+
+		if src.Size > s3.copyPartSize || (i < len(srcNames)-1 && src.Size < s3MinPartSize) {
+			copyable = false
+		}
+	}
+
+	if !copyable {
+		r := &s3ComposeReader{ctx: ctx, s3: s3, bucketName: bucketName, srcs: srcs}
+		defer r.Close()
+
+		return s3.write(ctx, bucketName, dstName, r, composeWriteOptions(opts), nil)
+	}
+
+	hdr := make(http.Header)
+	hdr.Set("Content-Type", srcs[0].ContentType)
+	if opts != nil {
+		if opts.ContentType != "" {
+			hdr.Set("Content-Type", opts.ContentType)
+		}
+		for k, v := range opts.Metadata {
+			hdr.Set(s3MetaPrefix+k, v)
+		}
+	}
+
+	n := 0
+
+	err := s3.multipartUpload(ctx, bucketName, dstName, hdr, nil, func(q url.Values) (string, bool, error) {
+		etag, err := s3.copyPart(ctx, q, bucketName, srcNames[n], srcs[n].ETag, bucketName, dstName, "")
+		n++
+
+		return etag, n == len(srcs), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.head(ctx, bucketName, dstName)
+}
+
+// removeVersion deletes a bucket file if it still has the etag in info. Services which ignore If-Match on deletes
+// would remove any version, so the delete is refused with ErrUnsupportedCondition unless they are known to honour it
+func (s3 *S3Mgr) removeVersion(ctx context.Context, bucketName, fileName string, info *ObjectInfo) error {
+	if !s3.conditionalDeletes || info.ETag == "" {
+		return ErrUnsupportedCondition
+	}
+
+	hdr := make(http.Header)
+	hdr.Set("If-Match", info.ETag)
+
+	resp, err := s3.do(ctx, http.MethodDelete, bucketName, fileName, nil, hdr, nil)
+	if err != nil {
+		return err
+	}
+	s3.close(resp, "removeVersion")
+
+	return nil
+}
+
+// copy copies the object with attributes src to the destination, using a single CopyObject if it is small enough and
+// UploadPartCopy otherwise. Each request only copies from the source etag, so that the copy fails with
+// ErrPreconditionFailed rather than mixing parts of two objects if the source is replaced part way through
+func (s3 *S3Mgr) copy(ctx context.Context, srcBucket, srcName string, src *ObjectInfo, dstBucket, dstName string) (*ObjectInfo, error) {
+	srcHdr := make(http.Header)
+	srcHdr.Set("X-Amz-Copy-Source", s3EncodePath("/"+srcBucket+"/"+srcName))
+	srcHdr.Set("X-Amz-Copy-Source-If-Match", src.ETag)
+
+	if src.Size <= s3.copyPartSize {
+		resp, err := s3.do(ctx, http.MethodPut, dstBucket, dstName, nil, srcHdr, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer s3.close(resp, "Copy")
+
+		if err := s3Result(resp, nil); err != nil {
+			return nil, err
+		}
+
+		return s3.head(ctx, dstBucket, dstName)
+	}
+
+	//multipart uploads do not copy the object attributes, so they are set when the upload is created
+	hdr := make(http.Header)
+	hdr.Set("Content-Type", src.ContentType)
+	if src.ContentEncoding != "" {
+		hdr.Set("Content-Encoding", src.ContentEncoding)
+	}
+	for k, v := range src.Metadata {
+		hdr.Set(s3MetaPrefix+k, v)
+	}
+
+	var offset int64
+
+	err := s3.multipartUpload(ctx, dstBucket, dstName, hdr, nil, func(q url.Values) (string, bool, error) {
+		end := min(offset+s3.copyPartSize, src.Size)
+
+		etag, err := s3.copyPart(ctx, q, srcBucket, srcName, src.ETag, dstBucket, dstName, fmt.Sprintf("bytes=%d-%d", offset, end-1))
+		offset = end
+
+		return etag, offset >= src.Size, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s3.head(ctx, dstBucket, dstName)
+	if err != nil {
+		return nil, err
+	}
+
+	//the copy has the same data, but S3 only reports an MD5 etag for single part uploads
+	info.MD5 = src.MD5
+	info.CRC32C = src.CRC32C
+
+	return info, nil
+}
+
+// copyPart copies a source object, or the byte range of it in rng if that is not empty, into a part of a multipart
+// upload with UploadPartCopy, and returns the part etag. The copy fails with ErrPreconditionFailed if the source no
+// longer has the etag srcETag
+func (s3 *S3Mgr) copyPart(ctx context.Context, q url.Values, srcBucket, srcName, srcETag, dstBucket, dstName, rng string) (string, error) {
+	hdr := make(http.Header)
+	hdr.Set("X-Amz-Copy-Source", s3EncodePath("/"+srcBucket+"/"+srcName))
+	hdr.Set("X-Amz-Copy-Source-If-Match", srcETag)
+	if rng != "" {
+		hdr.Set("X-Amz-Copy-Source-Range", rng)
+	}
+
+	resp, err := s3.do(ctx, http.MethodPut, dstBucket, dstName, q, hdr, nil)
+	if err != nil {
+		return "", err
+	}
+	defer s3.close(resp, "copyPart")
+
+	res := &s3CopyPartResult{}
+	if err := s3Result(resp, res); err != nil {
+		return "", err
+	}
+
+	return res.ETag, nil
+}
+
+// head returns the attributes of an object from a HeadObject request
+func (s3 *S3Mgr) head(ctx context.Context, bucketName, fileName string) (*ObjectInfo, error) {
+	hdr := make(http.Header)
+	hdr.Set("X-Amz-Checksum-Mode", "ENABLED")
+
+	resp, err := s3.do(ctx, http.MethodHead, bucketName, fileName, nil, hdr, nil)
+	if err != nil {
+		return nil, err
+	}
+	s3.close(resp, "head")
+
+	return s3ObjectInfo(bucketName, fileName, resp.Header, resp.ContentLength), nil
+}
+
+// Objects returns an iterator over the attributes of each object matching the prefix, requesting a ListObjectsV2 page
+// whenever the previous one has been used. ListObjectsV2 does not report content type, encoding or custom metadata,
+// so those attributes are always empty
+func (s3 *S3Mgr) Objects(ctx context.Context, bucketName, prefix string) *ListIterator {
+	return s3.QueryObjects(ctx, bucketName, &ListQuery{Prefix: prefix})
+}
+
+// QueryObjects returns an iterator over the attributes of each object selected by the query. ListObjectsV2 filters on
+// the prefix and starts after a given name, so StartOffset is sent as start-after, the other conditions are checked as
+// each page is read, and the listing stops once it passes EndOffset
+func (s3 *S3Mgr) QueryObjects(ctx context.Context, bucketName string, lq *ListQuery) *ListIterator {
+	q := s3.listQuery(lq.prefix())
+
+	//start-after is exclusive, so StartOffset is sent less its last character, and the names which sort between the
+	//two are dropped as the listing is read
+	if lq != nil && lq.StartOffset != "" {
+		_, size := utf8.DecodeLastRuneInString(lq.StartOffset)
+		if after := lq.StartOffset[:len(lq.StartOffset)-size]; after != "" {
+			q.Set("start-after", after)
+		}
+	}
+
+	var infos []*ObjectInfo
+	done := false
+
+	return lq.apply(newListIterator(ctx, func() (*ObjectInfo, error) {
+		for len(infos) == 0 {
+			if done {
+				return nil, iterator.Done
+			}
+
+			page, err := s3.listPage(ctx, bucketName, q)
+			if err != nil {
+				return nil, err
+			}
+
+			infos = s3ListInfos(bucketName, page)
+
+			done = !page.IsTruncated || page.NextContinuationToken == ""
+			q.Set("continuation-token", page.NextContinuationToken)
+		}
+
+		info := infos[0]
+		infos = infos[1:]
+
+		return info, nil
+	}))
+}
+
+// ListPage returns a single page of at most pageSize objects matching the prefix, starting from the page token
+// returned with the previous page. An empty token requests the first page, and a page size of zero or less uses
+// DefaultPageSize. The page token is the ListObjectsV2 continuation token
+func (s3 *S3Mgr) ListPage(ctx context.Context, bucketName, prefix string, pageSize int, pageToken string) (*ObjectPage, error) {
+	return s3.ListDir(ctx, bucketName, prefix, "", pageSize, pageToken)
+}
+
+// ListDir returns a single page of at most pageSize objects and common prefixes, starting from the page token returned
+// with the previous page. Objects whose names contain the delimiter after the prefix are returned as a common prefix
+// rather than individually, which gives a directory-style listing when the delimiter is "/". An empty delimiter lists
+// every object, as ListPage does
+func (s3 *S3Mgr) ListDir(ctx context.Context, bucketName, prefix, delimiter string, pageSize int, pageToken string) (*ObjectPage, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	q := s3.listQuery(prefix)
+	q.Set("max-keys", strconv.Itoa(pageSize))
+	if delimiter != "" {
+		q.Set("delimiter", delimiter)
+	}
+	if pageToken != "" {
+		q.Set("continuation-token", pageToken)
+	}
+
+	res, err := s3.listPage(ctx, bucketName, q)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ObjectPage{Objects: s3ListInfos(bucketName, res)}
+	for _, cp := range res.CommonPrefixes {
+		page.Prefixes = append(page.Prefixes, cp.Prefix)
+	}
+
+	if res.IsTruncated {
+		page.NextPageToken = res.NextContinuationToken
+	}
+
+	return page, nil
+}
+
+// ListObjects returns a configurable buffered channel which contains the attributes of each object matching the prefix.
+// ListObjectsV2 does not report content type, encoding or custom metadata, so those attributes are always empty
+func (s3 *S3Mgr) ListObjects(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan ObjectResult, error) {
+	return s3.ListObjectsQuery(ctx, bucketName, &ListQuery{Prefix: prefix}, bufferSize)
+}
+
+// ListObjectsQuery returns a configurable buffered channel which contains the attributes of each object selected by
+// the query
+func (s3 *S3Mgr) ListObjectsQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan ObjectResult, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	return streamIterator(ctx, s3.QueryObjects(ctx, bucketName, q), bufferSize), nil
+}
+
+// ListObjectsByTime returns a configurable buffered channel which contains the attributes of each object matching the
+// prefix which was created between start and end. S3 objects are immutable, so the last modified time is used as the
+// created time
+func (s3 *S3Mgr) ListObjectsByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan ObjectResult, error) {
+	//if the dates are not available, then exit with error
+	if start == nil || end == nil {
+		return nil, ErrMissingDateRange
+	}
+
+	return s3.ListObjectsQuery(ctx, bucketName, createdQuery(prefix, start, end), bufferSize)
+}
+
+// ListBucket returns a configurable buffered channel which contains a subset of object metadata. ListObjectsV2 does not
+// report content type or encoding, so those attributes are always empty
+func (s3 *S3Mgr) ListBucket(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan interface{}, error) {
+	return s3.ListBucketQuery(ctx, bucketName, &ListQuery{Prefix: prefix}, bufferSize)
+}
+
+// ListBucketByTime returns a configurable buffered channel which contains a subset of object metadata. S3 objects are
+// immutable, so the last modified time is used as the created time
+func (s3 *S3Mgr) ListBucketByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan interface{}, error) {
+	//if the dates are not available, then exit with error
+	if start == nil || end == nil {
+		return nil, ErrMissingDateRange
+	}
+
+	return s3.ListBucketQuery(ctx, bucketName, createdQuery(prefix, start, end), bufferSize)
+}
+
+// ListBucketQuery returns a configurable buffered channel which contains a subset of object metadata for each object
+// selected by the query
+func (s3 *S3Mgr) ListBucketQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan interface{}, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	return streamAttrs(ctx, s3.QueryObjects(ctx, bucketName, q), bufferSize), nil
+}
+
+// RemoveFile deletes a bucket file. Unless the service supports conditional deletes, deleting a missing object succeeds
+func (s3 *S3Mgr) RemoveFile(ctx context.Context, bucketName string, fileName string) error {
+	return s3.RemoveFileIf(ctx, bucketName, fileName, nil)
+}
+
+// RemoveObjects deletes the objects selected by opts with bounded concurrency, and returns a result for each. Objects
+// selected by prefix are only deleted if they are unchanged since they were listed, where the service supports
+// conditional deletes, and otherwise they are deleted whatever they hold by then
+func (s3 *S3Mgr) RemoveObjects(ctx context.Context, bucketName string, opts *RemoveOptions) ([]RemoveResult, error) {
+	if !s3.conditionalDeletes {
+		return removeObjects(ctx, s3UnguardedRemover{s3}, bucketName, opts)
+	}
+
+	return removeObjects(ctx, s3, bucketName, opts)
+}
+
+// s3UnguardedRemover deletes the objects which RemoveObjects selects without checking that they are unchanged, for
+// services which ignore If-Match on deletes
+type s3UnguardedRemover struct {
+	*S3Mgr
+}
+
+// removeVersion deletes a bucket file whatever version it holds
+func (r s3UnguardedRemover) removeVersion(ctx context.Context, bucketName, fileName string, info *ObjectInfo) error {
+	return r.RemoveFile(ctx, bucketName, fileName)
+}
+
+// RemoveFileIf deletes a bucket file if it meets the conditions. S3 objects have no generations, so any condition fails
+// with ErrUnsupportedCondition
+func (s3 *S3Mgr) RemoveFileIf(ctx context.Context, bucketName string, fileName string, cond *Conditions) error {
+	hdr, err := s3Conditions(cond, true)
+	if err != nil {
+		return err
+	}
+
+	//DeleteObject succeeds for missing keys, so where the service allows it the delete only matches an existing key,
+	//to match the GCS behaviour
+	if s3.conditionalDeletes {
+		hdr.Set("If-Match", "*")
+	}
+
+	resp, err := s3.do(ctx, http.MethodDelete, bucketName, fileName, nil, hdr, nil)
+	if err != nil {
+		return err
+	}
+	s3.close(resp, "RemoveFile")
+
+	return nil
+}
+
+// listQuery returns the ListObjectsV2 query parameters for a prefix
+func (s3 *S3Mgr) listQuery(prefix string) url.Values {
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("fetch-owner", "true")
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+
+	return q
+}
+
+// listPage requests a single ListObjectsV2 page
+func (s3 *S3Mgr) listPage(ctx context.Context, bucketName string, q url.Values) (*s3ListResult, error) {
+	resp, err := s3.do(ctx, http.MethodGet, bucketName, "", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s3.close(resp, "ListBucket")
+
+	page := &s3ListResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(page); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// do signs and sends a request, returning an error for any non-2xx response
+func (s3 *S3Mgr) do(ctx context.Context, method, bucketName, key string, q url.Values, hdr http.Header, body []byte) (*http.Response, error) {
+	if bucketName == "" || strings.Contains(bucketName, "/") {
+		return nil, ErrInvalidBucketName
+	}
+
+	u := *s3.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+
+	if s3.path {
+		u.Path = base + "/" + bucketName + "/" + key
+	} else {
+		u.Host = bucketName + "." + u.Host
+		u.Path = base + "/" + key
+	}
+	u.RawPath = s3EncodePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(q)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+
+	payloadHash := s3EmptyPayload
+	if len(body) > 0 {
+		payloadHash = s3PayloadHash(body)
+	}
+
+	s3.signer.sign(req, payloadHash, time.Now())
+
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	return nil, s3Err(resp, key)
+}
+
+// close drains and closes a response body, logging any failure
+func (s3 *S3Mgr) close(resp *http.Response, fn string) {
+	io.Copy(io.Discard, resp.Body)
+	if err := resp.Body.Close(); err != nil {
+		lblog.LogEvent("S3Mgr", fn, "error", err.Error())
+	}
+}
+
+// s3ReadPart reads up to size bytes from r, reporting whether the end of r was reached. A negative size reads all of r.
+// The part grows as data is read, so small objects do not allocate a whole part
+func s3ReadPart(r io.Reader, size int) ([]byte, bool, error) {
+	if size < 0 {
+		data, err := io.ReadAll(r)
+		return data, true, err
+	}
+
+	var part bytes.Buffer
+
+	_, err := io.CopyN(&part, r, int64(size))
+	switch err {
+	case nil:
+		return part.Bytes(), false, nil
+	case io.EOF:
+		return part.Bytes(), true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// s3Conditions returns the request headers for conditions on a write, or on a delete if del is set. S3 has no object
+// generations, so only DoesNotExist can be expressed, as If-None-Match
+func s3Conditions(c *Conditions, del bool) (http.Header, error) {
+	if err := c.validate(del); err != nil {
+		return nil, err
+	}
+
+	hdr := make(http.Header)
+	if c == nil {
+		return hdr, nil
+	}
+
+	if c.GenerationMatch != 0 || c.MetagenerationMatch != 0 {
+		return nil, ErrUnsupportedCondition
+	}
+
+	if c.DoesNotExist {
+		hdr.Set("If-None-Match", "*")
+	}
+
+	return hdr, nil
+}
+
+// s3ComposeReader reads source objects one after another, only requesting each once the one before has been read
+type s3ComposeReader struct {
+	ctx        context.Context
+	s3         *S3Mgr
+	bucketName string
+	srcs       []*ObjectInfo
+	rc         io.ReadCloser
+}
+
+// Read reads from the current source, moving on to the next when it is exhausted
+func (r *s3ComposeReader) Read(p []byte) (int, error) {
+	for {
+		if r.rc == nil {
+			if len(r.srcs) == 0 {
+				return 0, io.EOF
+			}
+
+			//each source must still be the version which was checked
+			hdr := make(http.Header)
+			hdr.Set("If-Match", r.srcs[0].ETag)
+
+			resp, err := r.s3.do(r.ctx, http.MethodGet, r.bucketName, r.srcs[0].Name, nil, hdr, nil)
+			if err != nil {
+				return 0, err
+			}
+
+			r.rc = resp.Body
+			r.srcs = r.srcs[1:]
+		}
+
+		n, err := r.rc.Read(p)
+		if err == io.EOF {
+			r.Close()
+			err = nil
+			if n == 0 {
+				continue
+			}
+		}
+
+		return n, err
+	}
+}
+
+// Close closes the current source
+func (r *s3ComposeReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+
+	err := r.rc.Close()
+	r.rc = nil
+
+	return err
+}
+
+// s3Result reads a response body into v, unless v is nil. Some requests can fail after the response has started, in
+// which case an error document is returned with a 200 status
+func s3Result(resp *http.Response, v interface{}) error {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	e := &S3Error{StatusCode: resp.StatusCode}
+	if xml.Unmarshal(data, e) == nil && e.Code != "" {
+		return classify(e)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return xml.Unmarshal(data, v)
+}
+
+// s3ListInfos returns the attributes of the objects in a ListObjectsV2 page. S3 objects are immutable, so the last
+// modified time is used as the created time
+func s3ListInfos(bucketName string, page *s3ListResult) []*ObjectInfo {
+	var infos []*ObjectInfo
+	for _, c := range page.Contents {
+		owner := c.Owner.DisplayName
+		if owner == "" {
+			owner = c.Owner.ID
+		}
+
+		infos = append(infos, &ObjectInfo{
+			Bucket:  bucketName,
+			Name:    c.Key,
+			Size:    c.Size,
+			Owner:   owner,
+			Created: c.LastModified.UTC(),
+			Updated: c.LastModified.UTC(),
+			ETag:    c.ETag,
+		})
+	}
+
+	return infos
+}
+
+// s3ObjectInfo returns the object attributes carried by GetObject and HeadObject response headers. S3 objects are
+// immutable, so the last modified time is used as the created time
+func s3ObjectInfo(bucketName, fileName string, hdr http.Header, size int64) *ObjectInfo {
+	info := &ObjectInfo{
+		Bucket:          bucketName,
+		Name:            fileName,
+		Size:            size,
+		ContentType:     hdr.Get("Content-Type"),
+		ContentEncoding: hdr.Get("Content-Encoding"),
+		ETag:            hdr.Get("ETag"),
+	}
+
+	//multipart etags are not an MD5 of the data, and carry a part count suffix
+	if sum, err := hex.DecodeString(strings.Trim(info.ETag, `"`)); err == nil && len(sum) == md5.Size {
+		info.MD5 = sum
+	}
+
+	if sum, err := base64.StdEncoding.DecodeString(hdr.Get("X-Amz-Checksum-Crc32c")); err == nil && len(sum) == 4 {
+		info.CRC32C = binary.BigEndian.Uint32(sum)
+	}
+
+	if lm, err := http.ParseTime(hdr.Get("Last-Modified")); err == nil {
+		info.Created = lm.UTC()
+		info.Updated = info.Created
+	}
+
+	for k, vs := range hdr {
+		if strings.HasPrefix(k, s3MetaPrefix) && len(vs) > 0 {
+			if info.Metadata == nil {
+				info.Metadata = make(map[string]string)
+			}
+			info.Metadata[strings.ToLower(strings.TrimPrefix(k, s3MetaPrefix))] = vs[0]
+		}
+	}
+
+	return info
+}
+
+// s3Err converts an error response into an error, mapping missing objects and buckets onto their storage equivalents
+func s3Err(resp *http.Response, key string) error {
+	e := &S3Error{StatusCode: resp.StatusCode}
+
+	//HEAD responses carry no body, so the status code is all there is to go on
+	if data, err := io.ReadAll(resp.Body); err == nil && len(data) > 0 {
+		xml.Unmarshal(data, e)
+	}
+
+	switch {
+	case e.Code == "NoSuchKey":
+		return classify(storage.ErrObjectNotExist)
+	case e.Code == "InvalidRange" || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return ErrInvalidRange
+	case e.Code == "NoSuchBucket":
+		return classify(storage.ErrBucketNotExist)
+	case resp.StatusCode == http.StatusNotFound && key != "" && e.Code == "":
+		return classify(storage.ErrObjectNotExist)
+	}
+
+	if e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+
+	return classify(e)
+}
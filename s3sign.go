@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	//s3SignAlgorithm is the signature version 4 algorithm name
+	s3SignAlgorithm = "AWS4-HMAC-SHA256"
+	//s3Service is the service name used in the credential scope
+	s3Service = "s3"
+	//s3TimeFormat is the x-amz-date format
+	s3TimeFormat = "20060102T150405Z"
+	//s3EmptyPayload is the hex encoded sha256 of an empty payload
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3UnsignedHeaders are never included in a signature, as they can be altered in transit
+var s3UnsignedHeaders = map[string]bool{
+	"authorization":   true,
+	"user-agent":      true,
+	"content-length":  true,
+	"accept-encoding": true,
+	"expect":          true,
+	"x-amzn-trace-id": true,
+}
+
+// s3Signer signs requests with AWS signature version 4
+type s3Signer struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+}
+
+// sign adds the x-amz-date, x-amz-content-sha256 and Authorization headers to a request
+func (sg *s3Signer) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3TimeFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if sg.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sg.sessionToken)
+	}
+
+	//sign the host plus everything else which will not change in transit
+	signed := []string{"host"}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if !s3UnsignedHeaders[lk] {
+			signed = append(signed, lk)
+		}
+	}
+	sort.Strings(signed)
+
+	scope := sg.scope(now)
+	sig := sg.signature(req, signed, payloadHash, amzDate, now)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s3SignAlgorithm, sg.accessKeyID, scope, strings.Join(signed, ";"), sig))
+}
+
+// scope returns the credential scope for a signing time
+func (sg *s3Signer) scope(now time.Time) string {
+	return strings.Join([]string{now.Format("20060102"), sg.region, s3Service, "aws4_request"}, "/")
+}
+
+// signature returns the hex encoded signature of a request over the named headers
+func (sg *s3Signer) signature(req *http.Request, signed []string, payloadHash, amzDate string, now time.Time) string {
+	canonical := s3CanonicalRequest(req, signed, payloadHash)
+	hash := sha256.Sum256([]byte(canonical))
+
+	toSign := strings.Join([]string{s3SignAlgorithm, amzDate, sg.scope(now), hex.EncodeToString(hash[:])}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+sg.secretAccessKey), now.Format("20060102"))
+	key = s3HMAC(key, sg.region)
+	key = s3HMAC(key, s3Service)
+	key = s3HMAC(key, "aws4_request")
+
+	return hex.EncodeToString(s3HMAC(key, toSign))
+}
+
+// s3CanonicalRequest builds the signature version 4 canonical request
+func s3CanonicalRequest(req *http.Request, signed []string, payloadHash string) string {
+	var hdrs strings.Builder
+	for _, h := range signed {
+		var v string
+		if h == "host" {
+			v = req.Host
+			if v == "" {
+				v = req.URL.Host
+			}
+		} else {
+			v = strings.Join(req.Header.Values(h), ",")
+		}
+
+		hdrs.WriteString(h)
+		hdrs.WriteString(":")
+		hdrs.WriteString(strings.Join(strings.Fields(v), " "))
+		hdrs.WriteString("\n")
+	}
+
+	uri := s3EncodePath(req.URL.Path)
+	if uri == "" {
+		uri = "/"
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		uri,
+		s3CanonicalQuery(req.URL.Query()),
+		hdrs.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// s3CanonicalQuery returns the query string sorted and encoded as signature version 4 requires
+func s3CanonicalQuery(q url.Values) string {
+	var parts []string
+	for k, vs := range q {
+		for _, v := range vs {
+			parts = append(parts, s3Encode(k, true)+"="+s3Encode(v, true))
+		}
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, "&")
+}
+
+// s3EncodePath encodes an object path, leaving the separators in place
+func s3EncodePath(p string) string {
+	return s3Encode(p, false)
+}
+
+// s3Encode percent encodes everything except the RFC 3986 unreserved characters. Slashes are also left
+// alone unless encodeSlash is set
+func s3Encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// s3HMAC returns the HMAC-SHA256 of data using key
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3PayloadHash returns the hex encoded sha256 of a payload
+func s3PayloadHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
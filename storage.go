@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
 	"io"
-	"sync"
+	"maps"
+	"net/http"
+	"strings"
 	"time"
 
 	lbcf "github.com/lidstromberg/config"
@@ -10,78 +14,122 @@ import (
 
 	"cloud.google.com/go/storage"
 	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
-// StorMgr handles interactions with GCS
+// StorMgr handles interactions with GCS, and is the GCS implementation of ObjectStore
 type StorMgr struct {
-	st *storage.Client
-	bc lbcf.ConfigSetting
+	st  *storage.Client
+	bc  lbcf.ConfigSetting
+	cfg *mgrConfig
 }
 
-// NewMgr returns a new storage manager
-func NewMgr(ctx context.Context, bc lbcf.ConfigSetting) (*StorMgr, error) {
-	preflight(ctx, bc)
+// NewMgr returns a new storage manager. Any client options, such as those returned by EmulatorOptions, are passed to the GCS client
+func NewMgr(ctx context.Context, bc lbcf.ConfigSetting, opts ...option.ClientOption) (*StorMgr, error) {
+	cfg := preflight(ctx, bc)
+	cfg.clientOpts = append(cfg.clientOpts, opts...)
 
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "NewMgr", "info", "start")
-	}
+	return newMgr(ctx, "NewMgr", cfg)
+}
 
-	storageClient, err := storage.NewClient(ctx, option.WithGRPCConnectionPool(EnvClientPool))
-	if err != nil {
-		return nil, err
-	}
+// NewJSONMgr returns a new storage manager based on a GCP credential supplied as a byte array. Any client options are passed to the GCS client
+func NewJSONMgr(ctx context.Context, bc lbcf.ConfigSetting, cred []byte, opts ...option.ClientOption) (*StorMgr, error) {
+	cfg := preflight(ctx, bc)
+	cfg.clientOpts = append(cfg.clientOpts, option.WithCredentialsJSON(cred))
+	cfg.clientOpts = append(cfg.clientOpts, opts...)
 
-	st1 := &StorMgr{
-		st: storageClient,
-		bc: bc,
+	return newMgr(ctx, "NewJSONMgr", cfg)
+}
+
+// NewMgrWithOptions returns a new storage manager configured by functional options. Environment variables are only read if
+// WithEnvConfig is supplied, and configuration problems are returned as errors rather than exiting
+func NewMgrWithOptions(ctx context.Context, opts ...Option) (*StorMgr, error) {
+	cfg := &mgrConfig{}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
 	}
 
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "NewMgr", "info", "end")
+	if cfg.bc == nil {
+		cfg.bc = lbcf.NewConfig(ctx)
 	}
 
-	return st1, nil
+	return newMgr(ctx, "NewMgrWithOptions", cfg)
 }
 
-// NewJSONMgr returns a new storage manager based on a GCP credential supplied as a byte array
-func NewJSONMgr(ctx context.Context, bc lbcf.ConfigSetting, cred []byte) (*StorMgr, error) {
-	preflight(ctx, bc)
-
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "NewJSONMgr", "info", "start")
+// newMgr returns a new storage manager which owns the supplied config
+func newMgr(ctx context.Context, fn string, cfg *mgrConfig) (*StorMgr, error) {
+	if cfg.debugOn {
+		lblog.LogEvent("StorMgr", fn, "info", "start")
 	}
 
-	storageClient, err := storage.NewClient(ctx, option.WithGRPCConnectionPool(EnvClientPool), option.WithCredentialsJSON(cred))
+	storageClient, err := storage.NewClient(ctx, cfg.clientOptions()...)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(cfg.retry) > 0 {
+		storageClient.SetRetry(cfg.retry...)
+	}
+
 	st1 := &StorMgr{
-		st: storageClient,
-		bc: bc,
+		st:  storageClient,
+		bc:  cfg.bc,
+		cfg: cfg,
 	}
 
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "NewJSONMgr", "info", "end")
+	if cfg.debugOn {
+		lblog.LogEvent("StorMgr", fn, "info", "end")
 	}
 
 	return st1, nil
 }
 
+// DebugOn reports whether verbose logging is on for this manager
+func (sto *StorMgr) DebugOn() bool {
+	return sto.cfg.debugOn
+}
+
+// PoolSize returns the client pool size for this manager
+func (sto *StorMgr) PoolSize() int {
+	return sto.cfg.poolSize
+}
+
+// EmulatorOptions returns the client options for a GCS emulator, such as fake-gcs-server, listening at endpoint.
+// The JSON API path is added to the endpoint if it is missing, and authentication is switched off
+func EmulatorOptions(endpoint string) []option.ClientOption {
+	return []option.ClientOption{
+		EndpointOption(endpoint),
+		option.WithoutAuthentication(),
+	}
+}
+
+// EndpointOption returns a client option which points the GCS client at a custom endpoint URL. The JSON API path is added
+// to the endpoint if it is missing
+func EndpointOption(endpoint string) option.ClientOption {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, gcsAPIPath) {
+		endpoint += gcsAPIPath
+	}
+
+	return option.WithEndpoint(endpoint + "/")
+}
+
 // GetBucketFileData returns a byte array for a bucket file
 func (sto *StorMgr) GetBucketFileData(ctx context.Context, bucketName string, fileName string) ([]byte, error) {
-	if EnvDebugOn {
+	if sto.cfg.debugOn {
 		lblog.LogEvent("StorMgr", "GetBucketFileData", "info", "start")
 	}
 
-	rc, err := sto.st.Bucket(bucketName).Object(fileName).NewReader(ctx)
+	rc, err := sto.GetBucketFileReader(ctx, bucketName, fileName)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(rc *storage.Reader) {
+	defer func(rc io.ReadCloser) {
 		err := rc.Close()
 		if err != nil {
 			lblog.LogEvent("StorMgr", "GetBucketFileData", "error", err.Error())
@@ -93,126 +141,485 @@ func (sto *StorMgr) GetBucketFileData(ctx context.Context, bucketName string, fi
 		return nil, err
 	}
 
-	if EnvDebugOn {
+	if sto.cfg.debugOn {
 		lblog.LogEvent("StorMgr", "GetBucketFileData", "info", "end")
 	}
 
 	return data, nil
 }
 
-// WriteBucketFile writes a file byte array to a bucket file
-func (sto *StorMgr) WriteBucketFile(ctx context.Context, bucketName string, fileName string, data []byte) error {
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "WriteBucketFile", "info", "start")
+// GetBucketFileReader returns a reader for a bucket file, which the caller must close. Reads fail once the context is done
+func (sto *StorMgr) GetBucketFileReader(ctx context.Context, bucketName string, fileName string) (io.ReadCloser, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "GetBucketFileReader", "info", "start")
 	}
 
-	wc := sto.st.Bucket(bucketName).Object(fileName).NewWriter(ctx)
-	defer func(wc *storage.Writer) {
-		err := wc.Close()
-		if err != nil {
-			lblog.LogEvent("StorMgr", "GetBucketFileData", "error", err.Error())
+	rc, err := sto.st.Bucket(bucketName).Object(fileName).NewReader(ctx)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "GetBucketFileReader", "info", "end")
+	}
+
+	return &ctxReader{ctx: ctx, rc: rc}, nil
+}
+
+// Stat returns the attributes of a bucket file without reading its data, failing with ErrNotFound if there is no
+// such file
+func (sto *StorMgr) Stat(ctx context.Context, bucketName string, fileName string) (*ObjectInfo, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Stat", "info", "start")
+	}
+
+	attrs, err := sto.st.Bucket(bucketName).Object(fileName).Attrs(ctx)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Stat", "info", "end")
+	}
+
+	return objectInfoFromAttrs(attrs), nil
+}
+
+// GetBucketFileRange returns a reader for length bytes of a bucket file starting at offset, which the caller must close.
+// A negative offset counts back from the end of the object and must be used with a negative length, which reads to the end
+func (sto *StorMgr) GetBucketFileRange(ctx context.Context, bucketName string, fileName string, offset, length int64) (io.ReadCloser, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "GetBucketFileRange", "info", "start")
+	}
+
+	if offset < 0 && length >= 0 {
+		return nil, ErrInvalidRange
+	}
+
+	rc, err := sto.st.Bucket(bucketName).Object(fileName).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusRequestedRangeNotSatisfiable {
+			return nil, ErrInvalidRange
 		}
-	}(wc)
+		return nil, classify(err)
+	}
 
-	if _, err := wc.Write(data); err != nil {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "GetBucketFileRange", "info", "end")
+	}
+
+	return &ctxReader{ctx: ctx, rc: rc}, nil
+}
+
+// StreamBucketFile copies a bucket file into w, returning the number of bytes copied
+func (sto *StorMgr) StreamBucketFile(ctx context.Context, bucketName string, fileName string, w io.Writer) (int64, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "StreamBucketFile", "info", "start")
+	}
+
+	n, err := streamBucketFile(ctx, sto, bucketName, fileName, w)
+	if err != nil {
+		return n, err
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "StreamBucketFile", "info", "end")
+	}
+
+	return n, nil
+}
+
+// WriteBucketFile writes a file byte array to a bucket file. An error is returned if the upload is not committed
+func (sto *StorMgr) WriteBucketFile(ctx context.Context, bucketName string, fileName string, data []byte) error {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "WriteBucketFile", "info", "start")
+	}
+
+	if _, err := sto.WriteBucketFileData(ctx, bucketName, fileName, data); err != nil {
 		return err
 	}
 
-	if EnvDebugOn {
+	if sto.cfg.debugOn {
 		lblog.LogEvent("StorMgr", "WriteBucketFile", "info", "end")
 	}
 
 	return nil
 }
 
-// ListBucket returns a configurable buffered channel which contains a subset of object metadata
-func (sto *StorMgr) ListBucket(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan interface{}, error) {
+// WriteBucketFileData writes a file byte array to a bucket file, returning the object attributes once the upload has been committed
+func (sto *StorMgr) WriteBucketFileData(ctx context.Context, bucketName string, fileName string, data []byte) (*ObjectInfo, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "WriteBucketFileData", "info", "start")
+	}
 
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "ListBucket", "info", "start")
+	info, err := sto.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "WriteBucketFileData", "info", "end")
+	}
+
+	return info, nil
+}
+
+// WriteBucketFileFrom streams the contents of r into a bucket file, returning the object attributes once the upload has been committed
+func (sto *StorMgr) WriteBucketFileFrom(ctx context.Context, bucketName string, fileName string, r io.Reader, opts *WriteOptions) (*ObjectInfo, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "WriteBucketFileFrom", "info", "start")
 	}
 
-	//waitgroup to control goroutines
-	var wg sync.WaitGroup
+	if err := opts.conditions().validate(false); err != nil {
+		return nil, err
+	}
 
-	//create the channel
-	result := make(chan interface{}, bufferSize)
+	obj := sto.st.Bucket(bucketName).Object(fileName)
+	if gc, ok := opts.conditions().gcs(); ok {
+		obj = obj.If(gc)
+	}
 
-	//bucket listing function
-	rfn := func(bucketname, prefix string) {
-		lbucketName := bucketname
-		lprefix := prefix
+	//cancelling the writer context is how an upload is abandoned
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		defer wg.Done()
+	wc := obj.NewWriter(wctx)
+	wc.ChunkSize = max(opts.chunkSize(), 0)
+	if opts != nil {
+		wc.ContentType = opts.ContentType
+		wc.ContentEncoding = opts.ContentEncoding
+		wc.Metadata = maps.Clone(opts.Metadata)
+	}
 
-		//get an iterator to the target bucket
-		it := &storage.ObjectIterator{}
+	if _, err := io.Copy(wc, r); err != nil {
+		cancel()
+		wc.Close()
+		return nil, classify(err)
+	}
 
-		//if a query prefix was supplied, then use it
-		if lprefix != "" {
-			qr := &storage.Query{
-				Prefix: lprefix,
-			}
+	//the upload is only committed once the writer is closed
+	if err := wc.Close(); err != nil {
+		return nil, classify(err)
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "WriteBucketFileFrom", "info", "end")
+	}
+
+	return objectInfoFromAttrs(wc.Attrs()), nil
+}
+
+// WriteBucketFileIf writes a file byte array to a bucket file if the existing object meets the conditions, returning the
+// object attributes once the upload has been committed. Unmet conditions fail with ErrPreconditionFailed
+func (sto *StorMgr) WriteBucketFileIf(ctx context.Context, bucketName string, fileName string, data []byte, cond *Conditions) (*ObjectInfo, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "WriteBucketFileIf", "info", "start")
+	}
+
+	info, err := sto.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), &WriteOptions{Conditions: cond})
+	if err != nil {
+		return nil, err
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "WriteBucketFileIf", "info", "end")
+	}
+
+	return info, nil
+}
+
+// Copy copies a bucket file to another name, which may be in another bucket, without downloading it. Large objects
+// take several rewrite calls, each continuing from the rewrite token returned by the last
+func (sto *StorMgr) Copy(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Copy", "info", "start")
+	}
+
+	info, err := sto.copy(ctx, sto.st.Bucket(srcBucket).Object(srcName), dstBucket, dstName)
+	if err != nil {
+		return nil, err
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Copy", "info", "end")
+	}
+
+	return info, nil
+}
+
+// Move moves a bucket file to another name, which may be in another bucket, by copying it and then deleting the
+// original. The original is only deleted if it has not been replaced since it was copied, and otherwise both objects
+// are kept and ErrPreconditionFailed is returned
+func (sto *StorMgr) Move(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Move", "info", "start")
+	}
+
+	//moving an object onto itself would delete it
+	if srcBucket == dstBucket && srcName == dstName {
+		return sto.Stat(ctx, srcBucket, srcName)
+	}
+
+	src := sto.st.Bucket(srcBucket).Object(srcName)
+
+	attrs, err := src.Attrs(ctx)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	info, err := sto.copy(ctx, src.Generation(attrs.Generation), dstBucket, dstName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := src.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx); err != nil {
+		return nil, classify(err)
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Move", "info", "end")
+	}
+
+	return info, nil
+}
+
+// copy rewrites src into the destination object. The copier repeats the rewrite call, passing back the rewrite token,
+// until the service reports that the whole object has been copied
+func (sto *StorMgr) copy(ctx context.Context, src *storage.ObjectHandle, dstBucket, dstName string) (*ObjectInfo, error) {
+	attrs, err := sto.st.Bucket(dstBucket).Object(dstName).CopierFrom(src).Run(ctx)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	return objectInfoFromAttrs(attrs), nil
+}
+
+// Compose concatenates the source objects into the destination, in order. GCS composes at most 32 objects per
+// request, so longer lists are composed in rounds through temporary objects, which are deleted afterwards. If the
+// destination was written but the temporary objects or sources could not all be deleted, its attributes are returned
+// along with the error
+func (sto *StorMgr) Compose(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Compose", "info", "start")
+	}
+
+	info, err := composeObjects(ctx, sto, gcsComposeLimit, bucketName, dstName, srcNames, opts)
+	if err != nil {
+		return info, err
+	}
 
-			itx := sto.st.Bucket(lbucketName).Objects(ctx, qr)
-			it = itx
-		} else {
-			itx := sto.st.Bucket(lbucketName).Objects(ctx, nil)
-			it = itx
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Compose", "info", "end")
+	}
+
+	return info, nil
+}
+
+// composeOnce composes up to 32 source objects into the destination with a single request
+func (sto *StorMgr) composeOnce(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error) {
+	bkt := sto.st.Bucket(bucketName)
+
+	srcs := make([]*storage.ObjectHandle, len(srcNames))
+	for i, name := range srcNames {
+		srcs[i] = bkt.Object(name)
+	}
+
+	c := bkt.Object(dstName).ComposerFrom(srcs...)
+	if opts != nil {
+		c.ContentType = opts.ContentType
+		c.Metadata = maps.Clone(opts.Metadata)
+	}
+
+	attrs, err := c.Run(ctx)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	return objectInfoFromAttrs(attrs), nil
+}
+
+// removeVersion deletes a bucket file if it still has the generation in info
+func (sto *StorMgr) removeVersion(ctx context.Context, bucketName, fileName string, info *ObjectInfo) error {
+	return sto.RemoveFileIf(ctx, bucketName, fileName, &Conditions{GenerationMatch: info.Generation})
+}
+
+// Update replaces the data of a bucket file with the result of fn, retrying if its generation changes in the meantime
+func (sto *StorMgr) Update(ctx context.Context, bucketName string, fileName string, fn UpdateFunc) (*ObjectInfo, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Update", "info", "start")
+	}
+
+	info, err := updateObject(ctx, fn, func() ([]byte, *ObjectInfo, error) {
+		return sto.readVersion(ctx, bucketName, fileName)
+	}, func(data []byte, cur *ObjectInfo) (*ObjectInfo, error) {
+		return sto.WriteBucketFileFrom(ctx, bucketName, fileName, bytes.NewReader(data), updateOptions(cur))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "Update", "info", "end")
+	}
+
+	return info, nil
+}
+
+// readVersion returns the data and attributes of a bucket file, or nil attributes if there is no such file. The data
+// is read from the generation described by the attributes, and ErrPreconditionFailed is returned if that generation
+// has since been replaced
+func (sto *StorMgr) readVersion(ctx context.Context, bucketName string, fileName string) ([]byte, *ObjectInfo, error) {
+	obj := sto.st.Bucket(bucketName).Object(fileName)
+
+	attrs, err := obj.Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, classify(err)
+	}
+
+	//the stored bytes are read, as they are written back with the same content encoding
+	rc, err := obj.Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil, ErrPreconditionFailed
+	}
+	if err != nil {
+		return nil, nil, classify(err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, objectInfoFromAttrs(attrs), nil
+}
+
+// Objects returns an iterator over the attributes of each object matching the prefix
+func (sto *StorMgr) Objects(ctx context.Context, bucketName, prefix string) *ListIterator {
+	return sto.QueryObjects(ctx, bucketName, &ListQuery{Prefix: prefix})
+}
+
+// QueryObjects returns an iterator over the attributes of each object selected by the query. The prefix, name offsets
+// and glob pattern are applied by GCS, and the other conditions are checked as the listing is read. The glob is left
+// to GCS alone, so that names which GCS matches are not dropped where the local glob syntax differs
+func (sto *StorMgr) QueryObjects(ctx context.Context, bucketName string, q *ListQuery) *ListIterator {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "QueryObjects", "info", "start")
+	}
+
+	qr := &storage.Query{}
+	if q != nil {
+		qr.Prefix = q.Prefix
+		qr.StartOffset = q.StartOffset
+		qr.EndOffset = q.EndOffset
+		qr.MatchGlob = q.MatchGlob
+	}
+
+	it := sto.st.Bucket(bucketName).Objects(ctx, qr)
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "QueryObjects", "info", "end")
+	}
+
+	return q.withoutGlob().apply(newListIterator(ctx, func() (*ObjectInfo, error) {
+		attrs, err := it.Next()
+		if err != nil {
+			return nil, err
 		}
 
-		//collect the subset of attributes
-		for {
-			attrs, err := it.Next()
-			if err != nil {
-				if err == iterator.Done {
-					return
-				}
+		return objectInfoFromAttrs(attrs), nil
+	}))
+}
 
-				//send back the error if any occur
-				result <- err
-				return
-			}
+// ListPage returns a single page of at most pageSize objects matching the prefix, starting from the page token
+// returned with the previous page. An empty token requests the first page, and a page size of zero or less uses
+// DefaultPageSize. Pages are read through the object iterator's PageInfo, so the token is the GCS page token
+func (sto *StorMgr) ListPage(ctx context.Context, bucketName, prefix string, pageSize int, pageToken string) (*ObjectPage, error) {
+	return sto.ListDir(ctx, bucketName, prefix, "", pageSize, pageToken)
+}
 
-			//collect the attributes
-			at := make(map[string]interface{})
+// ListDir returns a single page of at most pageSize objects and common prefixes, starting from the page token returned
+// with the previous page. Objects whose names contain the delimiter after the prefix are returned as a common prefix
+// rather than individually, which gives a directory-style listing when the delimiter is "/". An empty delimiter lists
+// every object, as ListPage does
+func (sto *StorMgr) ListDir(ctx context.Context, bucketName, prefix, delimiter string, pageSize int, pageToken string) (*ObjectPage, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListDir", "info", "start")
+	}
 
-			at[ObjAttrName] = attrs.Name
-			at[ObjAttrContentType] = attrs.ContentType
-			at[ObjAttrOwner] = attrs.Owner
-			at[ObjAttrSize] = attrs.Size
-			at[ObjAttrContentEncoding] = attrs.ContentEncoding
-			at[ObjAttrCreated] = attrs.Created.Unix()
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
 
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				result <- at
-			}
+	it := sto.st.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: delimiter})
+
+	var attrs []*storage.ObjectAttrs
+	nextToken, err := iterator.NewPager(it, pageSize, pageToken).NextPage(&attrs)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	page := &ObjectPage{NextPageToken: nextToken}
+	for _, at := range attrs {
+		//common prefixes are returned as attributes holding only the prefix
+		if at.Prefix != "" {
+			page.Prefixes = append(page.Prefixes, at.Prefix)
+			continue
 		}
+		page.Objects = append(page.Objects, objectInfoFromAttrs(at))
 	}
 
-	wg.Add(1)
-	go rfn(bucketName, prefix)
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListDir", "info", "end")
+	}
 
-	go func() {
-		wg.Wait()
-		close(result)
-	}()
+	return page, nil
+}
 
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "ListBucket", "info", "end")
+// ListObjects returns a configurable buffered channel which contains the attributes of each object matching the prefix
+func (sto *StorMgr) ListObjects(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan ObjectResult, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListObjects", "info", "start")
+	}
+
+	result := streamIterator(ctx, sto.Objects(ctx, bucketName, prefix), bufferSize)
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListObjects", "info", "end")
 	}
 
 	return result, nil
 }
 
-// ListBucketByTime returns a configurable buffered channel which contains a subset of object metadata
-func (sto *StorMgr) ListBucketByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan interface{}, error) {
+// ListObjectsQuery returns a configurable buffered channel which contains the attributes of each object selected by
+// the query
+func (sto *StorMgr) ListObjectsQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan ObjectResult, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListObjectsQuery", "info", "start")
+	}
 
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "ListBucketByTime", "info", "start")
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	result := streamIterator(ctx, sto.QueryObjects(ctx, bucketName, q), bufferSize)
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListObjectsQuery", "info", "end")
+	}
+
+	return result, nil
+}
+
+// ListObjectsByTime returns a configurable buffered channel which contains the attributes of each object matching the
+// prefix which was created between start and end
+func (sto *StorMgr) ListObjectsByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan ObjectResult, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListObjectsByTime", "info", "start")
 	}
 
 	//if the dates are not available, then exit with error
@@ -220,79 +627,67 @@ func (sto *StorMgr) ListBucketByTime(ctx context.Context, bucketName, prefix str
 		return nil, ErrMissingDateRange
 	}
 
-	//waitgroup to control goroutines
-	var wg sync.WaitGroup
+	result := streamIterator(ctx, sto.QueryObjects(ctx, bucketName, createdQuery(prefix, start, end)), bufferSize)
 
-	//create the channel
-	result := make(chan interface{}, bufferSize)
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListObjectsByTime", "info", "end")
+	}
 
-	//bucket listing function
-	rfn := func(bucketname, prefix string) {
-		lbucketName := bucketname
-		lprefix := prefix
+	return result, nil
+}
 
-		defer wg.Done()
+// ListBucket returns a configurable buffered channel which contains a subset of object metadata. The listing stops
+// once the context is done, so cancel it if the channel will not be read until it is closed
+func (sto *StorMgr) ListBucket(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan interface{}, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListBucket", "info", "start")
+	}
 
-		//get an iterator to the target bucket
-		it := &storage.ObjectIterator{}
+	result := streamAttrs(ctx, sto.Objects(ctx, bucketName, prefix), bufferSize)
 
-		//if a query prefix was supplied, then use it
-		if lprefix != "" {
-			qr := &storage.Query{
-				Prefix: lprefix,
-			}
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListBucket", "info", "end")
+	}
 
-			itx := sto.st.Bucket(lbucketName).Objects(ctx, qr)
-			it = itx
-		} else {
-			itx := sto.st.Bucket(lbucketName).Objects(ctx, nil)
-			it = itx
-		}
+	return result, nil
+}
 
-		//collect the subset of attributes
-		for {
-			attrs, err := it.Next()
-			if err != nil {
-				if err == iterator.Done {
-					return
-				}
+// ListBucketByTime returns a configurable buffered channel which contains a subset of object metadata. The listing
+// stops once the context is done, so cancel it if the channel will not be read until it is closed
+func (sto *StorMgr) ListBucketByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan interface{}, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListBucketByTime", "info", "start")
+	}
 
-				//send back the error if any occur
-				result <- err
-				return
-			}
+	//if the dates are not available, then exit with error
+	if start == nil || end == nil {
+		return nil, ErrMissingDateRange
+	}
 
-			//collect the object attributes if the object is created within the required date range
-			if attrs.Created.After(*start) && attrs.Created.Before(*end) {
-				at := make(map[string]interface{})
-
-				at[ObjAttrName] = attrs.Name
-				at[ObjAttrContentType] = attrs.ContentType
-				at[ObjAttrOwner] = attrs.Owner
-				at[ObjAttrSize] = attrs.Size
-				at[ObjAttrContentEncoding] = attrs.ContentEncoding
-				at[ObjAttrCreated] = attrs.Created.Unix()
-
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					result <- at
-				}
-			}
-		}
+	result := streamAttrs(ctx, sto.QueryObjects(ctx, bucketName, createdQuery(prefix, start, end)), bufferSize)
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListBucketByTime", "info", "end")
 	}
 
-	wg.Add(1)
-	go rfn(bucketName, prefix)
+	return result, nil
+}
 
-	go func() {
-		wg.Wait()
-		close(result)
-	}()
+// ListBucketQuery returns a configurable buffered channel which contains a subset of object metadata for each object
+// selected by the query
+func (sto *StorMgr) ListBucketQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan interface{}, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListBucketQuery", "info", "start")
+	}
 
-	if EnvDebugOn {
-		lblog.LogEvent("StorMgr", "ListBucketByTime", "info", "end")
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	result := streamAttrs(ctx, sto.QueryObjects(ctx, bucketName, q), bufferSize)
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "ListBucketQuery", "info", "end")
 	}
 
 	return result, nil
@@ -300,22 +695,66 @@ func (sto *StorMgr) ListBucketByTime(ctx context.Context, bucketName, prefix str
 
 // RemoveFile deletes a bucket file
 func (sto *StorMgr) RemoveFile(ctx context.Context, bucketName string, fileName string) error {
-	if EnvDebugOn {
+	if sto.cfg.debugOn {
 		lblog.LogEvent("StorMgr", "RemoveFile", "info", "start")
 	}
 
-	err := sto.st.Bucket(bucketName).Object(fileName).Delete(ctx)
-	if err != nil {
+	if err := sto.RemoveFileIf(ctx, bucketName, fileName, nil); err != nil {
 		return err
 	}
 
-	if EnvDebugOn {
+	if sto.cfg.debugOn {
 		lblog.LogEvent("StorMgr", "RemoveFile", "info", "end")
 	}
 
 	return nil
 }
 
+// RemoveFileIf deletes a bucket file if it meets the conditions. Unmet conditions fail with ErrPreconditionFailed
+func (sto *StorMgr) RemoveFileIf(ctx context.Context, bucketName string, fileName string, cond *Conditions) error {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "RemoveFileIf", "info", "start")
+	}
+
+	if err := cond.validate(true); err != nil {
+		return err
+	}
+
+	obj := sto.st.Bucket(bucketName).Object(fileName)
+	if gc, ok := cond.gcs(); ok {
+		obj = obj.If(gc)
+	}
+
+	if err := obj.Delete(ctx); err != nil {
+		return classify(err)
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "RemoveFileIf", "info", "end")
+	}
+
+	return nil
+}
+
+// RemoveObjects deletes the objects selected by opts with bounded concurrency, and returns a result for each. Objects
+// selected by prefix are only deleted if they are unchanged since they were listed
+func (sto *StorMgr) RemoveObjects(ctx context.Context, bucketName string, opts *RemoveOptions) ([]RemoveResult, error) {
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "RemoveObjects", "info", "start")
+	}
+
+	results, err := removeObjects(ctx, sto, bucketName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if sto.cfg.debugOn {
+		lblog.LogEvent("StorMgr", "RemoveObjects", "info", "end")
+	}
+
+	return results, nil
+}
+
 // DrainFn drains a channel until it is closed
 func DrainFn(c <-chan interface{}) {
 	for {
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	lblog "github.com/lidstromberg/log"
+)
+
+// ObjectStore defines the core operations served by a storage backend, which are kept few so that a test fake can
+// stand in for a backend. The further operations are grouped into the capability interfaces below, which every backend
+// in this package also satisfies. The channel listings are fed by a goroutine which exits once the listing is complete
+// or the context is done, so a caller which stops reading early must cancel the context
+type ObjectStore interface {
+	//GetBucketFileData returns a byte array for a bucket file
+	GetBucketFileData(ctx context.Context, bucketName string, fileName string) ([]byte, error)
+	//WriteBucketFile writes a file byte array to a bucket file
+	WriteBucketFile(ctx context.Context, bucketName string, fileName string, data []byte) error
+	//ListBucket returns a buffered channel which contains a subset of object metadata
+	ListBucket(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan interface{}, error)
+	//ListBucketByTime returns a buffered channel which contains a subset of object metadata for objects created between start and end
+	ListBucketByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan interface{}, error)
+	//RemoveFile deletes a bucket file
+	RemoveFile(ctx context.Context, bucketName string, fileName string) error
+}
+
+// Stater reads object attributes
+type Stater interface {
+	//Stat returns the attributes of a bucket file without reading its data
+	Stat(ctx context.Context, bucketName string, fileName string) (*ObjectInfo, error)
+}
+
+// Streamer reads and writes objects as streams, and returns the attributes of what it writes
+type Streamer interface {
+	//GetBucketFileReader returns a reader for a bucket file, which the caller must close
+	GetBucketFileReader(ctx context.Context, bucketName string, fileName string) (io.ReadCloser, error)
+	//GetBucketFileRange returns a reader for length bytes of a bucket file starting at offset, which the caller must close
+	GetBucketFileRange(ctx context.Context, bucketName string, fileName string, offset, length int64) (io.ReadCloser, error)
+	//StreamBucketFile copies a bucket file into w, returning the number of bytes copied
+	StreamBucketFile(ctx context.Context, bucketName string, fileName string, w io.Writer) (int64, error)
+	//WriteBucketFileData writes a file byte array to a bucket file, returning the object attributes once the write has been committed
+	WriteBucketFileData(ctx context.Context, bucketName string, fileName string, data []byte) (*ObjectInfo, error)
+	//WriteBucketFileFrom streams the contents of r into a bucket file, returning the object attributes once the write has been committed
+	WriteBucketFileFrom(ctx context.Context, bucketName string, fileName string, r io.Reader, opts *WriteOptions) (*ObjectInfo, error)
+}
+
+// ConditionalWriter writes and deletes objects only if they meet preconditions
+type ConditionalWriter interface {
+	//WriteBucketFileIf writes a file byte array to a bucket file if the existing object meets the conditions
+	WriteBucketFileIf(ctx context.Context, bucketName string, fileName string, data []byte, cond *Conditions) (*ObjectInfo, error)
+	//RemoveFileIf deletes a bucket file if it meets the conditions
+	RemoveFileIf(ctx context.Context, bucketName string, fileName string, cond *Conditions) error
+}
+
+// Updater makes read-modify-write updates of objects
+type Updater interface {
+	//Update replaces the data of a bucket file with the result of fn, retrying if the object changes in the meantime
+	Update(ctx context.Context, bucketName string, fileName string, fn UpdateFunc) (*ObjectInfo, error)
+}
+
+// Copier copies and moves objects without downloading them
+type Copier interface {
+	//Copy copies a bucket file to another name, which may be in another bucket, without downloading it
+	Copy(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error)
+	//Move moves a bucket file to another name, which may be in another bucket, deleting the original only if it is unchanged
+	Move(ctx context.Context, srcBucket, srcName, dstBucket, dstName string) (*ObjectInfo, error)
+}
+
+// Composer concatenates objects
+type Composer interface {
+	//Compose concatenates the source objects into the destination, chaining composes if there are more sources than the backend allows
+	Compose(ctx context.Context, bucketName, dstName string, srcNames []string, opts *ComposeOptions) (*ObjectInfo, error)
+}
+
+// Lister lists objects through iterators, pages and typed channels
+type Lister interface {
+	//Objects returns an iterator over the attributes of each object matching the prefix
+	Objects(ctx context.Context, bucketName, prefix string) *ListIterator
+	//QueryObjects returns an iterator over the attributes of each object selected by the query
+	QueryObjects(ctx context.Context, bucketName string, q *ListQuery) *ListIterator
+	//ListPage returns a single page of at most pageSize objects matching the prefix, starting from the page token returned with the previous page
+	ListPage(ctx context.Context, bucketName, prefix string, pageSize int, pageToken string) (*ObjectPage, error)
+	//ListDir returns a single page of objects and common prefixes, where objects whose names contain the delimiter after the prefix are returned as a common prefix
+	ListDir(ctx context.Context, bucketName, prefix, delimiter string, pageSize int, pageToken string) (*ObjectPage, error)
+	//ListObjects returns a buffered channel which contains the attributes of each object matching the prefix
+	ListObjects(ctx context.Context, bucketName, prefix string, bufferSize int) (<-chan ObjectResult, error)
+	//ListObjectsQuery returns a buffered channel which contains the attributes of each object selected by the query
+	ListObjectsQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan ObjectResult, error)
+	//ListObjectsByTime returns a buffered channel which contains the attributes of each object matching the prefix which was created between start and end
+	ListObjectsByTime(ctx context.Context, bucketName, prefix string, start, end *time.Time, bufferSize int) (<-chan ObjectResult, error)
+	//ListBucketQuery returns a buffered channel which contains a subset of object metadata for each object selected by the query
+	ListBucketQuery(ctx context.Context, bucketName string, q *ListQuery, bufferSize int) (<-chan interface{}, error)
+}
+
+// Remover deletes objects in bulk
+type Remover interface {
+	//RemoveObjects deletes the objects selected by name or prefix, and reports the result for each
+	RemoveObjects(ctx context.Context, bucketName string, opts *RemoveOptions) ([]RemoveResult, error)
+}
+
+var (
+	//StorMgr is the GCS implementation of ObjectStore
+	_ ObjectStore = (*StorMgr)(nil)
+	//MemMgr is the in-memory implementation of ObjectStore
+	_ ObjectStore = (*MemMgr)(nil)
+	//FileMgr is the local filesystem implementation of ObjectStore
+	_ ObjectStore = (*FileMgr)(nil)
+	//S3Mgr is the S3-compatible implementation of ObjectStore
+	_ ObjectStore = (*S3Mgr)(nil)
+)
+
+// capabilities lists every capability interface, so that each backend is checked against all of them
+type capabilities interface {
+	ObjectStore
+	Stater
+	Streamer
+	ConditionalWriter
+	Updater
+	Copier
+	Composer
+	Lister
+	Remover
+}
+
+var (
+	_ capabilities = (*StorMgr)(nil)
+	_ capabilities = (*MemMgr)(nil)
+	_ capabilities = (*FileMgr)(nil)
+	_ capabilities = (*S3Mgr)(nil)
+)
+
+// streamAttrs returns a buffered channel which is fed the metadata maps of the objects from it, as sent by the
+// ListBucket methods, and closed once the iterator stops or the context is done. An iterator error is sent as the
+// final item unless the context is done
+func streamAttrs(ctx context.Context, it *ListIterator, bufferSize int) <-chan interface{} {
+	return streamList(ctx, it, bufferSize, func(info *ObjectInfo, err error) interface{} {
+		if err != nil {
+			return err
+		}
+		return info.attrs()
+	})
+}
+
+// ctxReader is a reader which fails once its context is done, for backends whose reads do not watch the context, and
+// for readers which buffer data that would otherwise still be returned after the context is done
+type ctxReader struct {
+	ctx context.Context
+	rc  io.ReadCloser
+}
+
+// Read reads from the underlying reader unless the context is done
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.rc.Read(p)
+}
+
+// Close closes the underlying reader
+func (cr *ctxReader) Close() error {
+	return cr.rc.Close()
+}
+
+// bucketFileReader is implemented by backends which can open a reader on a bucket file
+type bucketFileReader interface {
+	GetBucketFileReader(ctx context.Context, bucketName string, fileName string) (io.ReadCloser, error)
+}
+
+// streamBucketFile copies a bucket file from a backend into w
+func streamBucketFile(ctx context.Context, sto bucketFileReader, bucketName string, fileName string, w io.Writer) (int64, error) {
+	rc, err := sto.GetBucketFileReader(ctx, bucketName, fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func(rc io.ReadCloser) {
+		err := rc.Close()
+		if err != nil {
+			lblog.LogEvent("ObjectStore", "StreamBucketFile", "error", err.Error())
+		}
+	}(rc)
+
+	return io.Copy(w, rc)
+}
+
+// rangeBounds validates a range request against an object of the given size, returning the absolute start offset and
+// the number of bytes to read, which is negative when reading to the end
+func rangeBounds(size, offset, length int64) (int64, int64, error) {
+	if offset < 0 && length >= 0 {
+		return 0, 0, ErrInvalidRange
+	}
+
+	//negative offsets count back from the end, stopping at the start of the object
+	start := offset
+	if offset < 0 {
+		start = max(size+offset, 0)
+	}
+
+	if start > size || (start == size && offset > 0 && length != 0) {
+		return 0, 0, ErrInvalidRange
+	}
+
+	return start, length, nil
+}
+
+// rangeReader returns a reader over part of rc, for backends without native range reads. The start of the range is
+// found by seeking where rc supports it, and by discarding data otherwise. Closing the reader closes rc
+func rangeReader(rc io.ReadCloser, size, offset, length int64) (io.ReadCloser, error) {
+	start, length, err := rangeBounds(size, offset, length)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	if sk, ok := rc.(io.Seeker); ok {
+		if _, err := sk.Seek(start, io.SeekStart); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	} else if _, err := io.CopyN(io.Discard, rc, start); err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	var r io.Reader = rc
+	if length >= 0 {
+		r = io.LimitReader(rc, length)
+	}
+
+	return &rangeReadCloser{Reader: r, Closer: rc}, nil
+}
+
+// rangeReadCloser reads a range of an underlying reader, and closes the underlying reader
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
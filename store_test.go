@@ -0,0 +1,1856 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// errTestRead is returned by readers which are made to fail
+var errTestRead = errors.New("test read failure")
+
+// testOtherBucket is the second bucket given to each backend by storeBackends, for checks which use two buckets
+const testOtherBucket = "otherbucket"
+
+// storeBackend opens a new backend for each of the shared checks
+type storeBackend struct {
+	name string
+	//bucketName is an empty bucket on the backend, alongside testOtherBucket
+	bucketName string
+	//generations is set if the backend supports generation conditions
+	generations bool
+	//open returns the backend. Where it would split listings into small pages to exercise continuation, fullPages
+	//asks for pages of the requested size instead
+	open func(t *testing.T, fullPages bool) capabilities
+}
+
+// storeChecks are the checks which every backend must pass
+var storeChecks = []struct {
+	name string
+	fn   func(t *testing.T, sto capabilities, bucketName string)
+	//fullPages is set for checks of the page sizes which a listing returns
+	fullPages bool
+	//generations is set for checks which need generation conditions
+	generations bool
+}{
+	{name: "ListObjects", fn: checkListObjects},
+	{name: "Objects", fn: checkObjects},
+	{name: "ListingCancel", fn: checkListingCancel},
+	{name: "ListPage", fn: checkListPage, fullPages: true},
+	{name: "ListDir", fn: checkListDir, fullPages: true},
+	{name: "ListObjectsQuery", fn: checkListObjectsQuery},
+	{name: "ListFilters", fn: checkListFilters},
+	{name: "StreamBucketFile", fn: checkStreamBucketFile},
+	{name: "Stat", fn: checkStat},
+	{name: "Errors", fn: checkErrors},
+	{name: "Conditions", fn: checkConditions},
+	{name: "GenerationConditions", fn: checkGenerationConditions, generations: true},
+	{name: "Update", fn: checkUpdate},
+	{name: "UpdateEncoded", fn: checkUpdateEncoded},
+	{name: "CopyMove", fn: checkCopyMove},
+	{name: "Compose", fn: checkCompose},
+	{name: "RemoveObjects", fn: checkRemoveObjects},
+	{name: "GetBucketFileRange", fn: checkGetBucketFileRange},
+	{name: "WriteBucketFileFrom", fn: checkWriteBucketFileFrom},
+}
+
+// storeBackends are the backends which are run through storeChecks
+var storeBackends = []storeBackend{
+	{
+		name:        "Mem",
+		bucketName:  "membucket",
+		generations: true,
+		open: func(t *testing.T, fullPages bool) capabilities {
+			return NewMemMgr()
+		},
+	},
+	{
+		name:        "File",
+		bucketName:  "filebucket",
+		generations: true,
+		open: func(t *testing.T, fullPages bool) capabilities {
+			sto, err := NewFileMgr(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//no staged data should be left behind
+			t.Cleanup(func() {
+				if tmp, err := os.ReadDir(filepath.Join(sto.root, fileTempDir)); err != nil || len(tmp) != 0 {
+					t.Errorf("%d temporary files left behind, %v", len(tmp), err)
+				}
+			})
+
+			return sto
+		},
+	},
+	{
+		name:       "S3",
+		bucketName: "s3bucket",
+		open:       openS3Backend(true),
+	},
+	{
+		name:       "S3Unguarded",
+		bucketName: "s3bucket",
+		open:       openS3Backend(false),
+	},
+	{
+		name:        "Emulator",
+		bucketName:  "gcsbucket",
+		generations: true,
+		open: func(t *testing.T, fullPages bool) capabilities {
+			fk, sto := newEmulatorMgr(t, "gcsbucket")
+
+			fk.mu.Lock()
+			fk.buckets[testOtherBucket] = map[string]*gcsFakeObject{}
+			fk.mu.Unlock()
+
+			return sto
+		},
+	},
+}
+
+// openS3Backend returns the open function of an S3 backend, which is run with and without conditional deletes as
+// S3-compatible services differ
+func openS3Backend(conditional bool) func(t *testing.T, fullPages bool) capabilities {
+	return func(t *testing.T, fullPages bool) capabilities {
+		fk, sto := newS3Fake(t, "s3bucket")
+		sto.conditionalDeletes = conditional
+
+		fk.mu.Lock()
+		fk.buckets[testOtherBucket] = map[string]*s3FakeObject{}
+		if fullPages {
+			fk.pageSize = DefaultPageSize
+		}
+		fk.mu.Unlock()
+
+		//no multipart uploads should be left behind
+		t.Cleanup(func() {
+			fk.mu.Lock()
+			defer fk.mu.Unlock()
+
+			if len(fk.uploads) != 0 {
+				t.Errorf("%d multipart uploads left open", len(fk.uploads))
+			}
+		})
+
+		return sto
+	}
+}
+
+// conditionalDeletes reports whether a backend's deletes can be conditional. Without them a delete of a missing object
+// succeeds, and Move and Compose with DeleteSources are refused
+func conditionalDeletes(sto capabilities) bool {
+	s3, ok := sto.(*S3Mgr)
+	return !ok || s3.conditionalDeletes
+}
+
+func Test_Stores(t *testing.T) {
+	for _, check := range storeChecks {
+		t.Run(check.name, func(t *testing.T) {
+			for _, b := range storeBackends {
+				if check.generations && !b.generations {
+					continue
+				}
+
+				t.Run(b.name, func(t *testing.T) {
+					check.fn(t, b.open(t, check.fullPages), b.bucketName)
+				})
+			}
+		})
+	}
+}
+
+func Test_RangeReader(t *testing.T) {
+	dat := "0123456789"
+
+	//readers which cannot seek have the start of the range discarded
+	for _, rc := range []io.ReadCloser{
+		io.NopCloser(strings.NewReader(dat)),
+		seekNopCloser{strings.NewReader(dat)},
+	} {
+		rr, err := rangeReader(rc, int64(len(dat)), 3, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := io.ReadAll(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != "3456" {
+			t.Fatalf("range read %q, want %q", got, "3456")
+		}
+	}
+}
+
+func Test_ListIterator(t *testing.T) {
+	ctx := context.Background()
+
+	infos := []*ObjectInfo{{Name: "a", Size: 1}, {Name: "b", Size: 2}, {Name: "c", Size: 3}}
+
+	before := runtime.NumGoroutine()
+
+	//filtered objects are skipped
+	it := sliceIterator(ctx, infos)
+	it.keep = func(info *ObjectInfo) bool { return info.Size != 2 }
+
+	var got []string
+	for info, err := range it.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, info.Name)
+	}
+
+	if strings.Join(got, ",") != "a,c" {
+		t.Fatalf("unexpected listing %v", got)
+	}
+
+	//the end offset stops the listing without reading further
+	reads := 0
+	it = newListIterator(ctx, func() (*ObjectInfo, error) {
+		reads++
+		return infos[min(reads, len(infos))-1], nil
+	})
+	it.end = "b"
+
+	if !it.Next() || it.Next() || it.Err() != nil || reads != 2 {
+		t.Fatalf("end offset read %d objects, want 2", reads)
+	}
+
+	//errors stop the iterator
+	it = errIterator(ctx, errTestRead)
+	if it.Next() || it.Err() != errTestRead {
+		t.Fatalf("failed iterator returned %v, want errTestRead", it.Err())
+	}
+
+	//iteration does not start any goroutines
+	if after := runtime.NumGoroutine(); after != before {
+		t.Fatalf("goroutines went from %d to %d", before, after)
+	}
+}
+
+func Test_UpdateAttempts(t *testing.T) {
+	calls := 0
+
+	//a write which always conflicts gives up after the last attempt, rather than retrying forever
+	_, err := updateObject(context.Background(), func(data []byte) ([]byte, error) {
+		calls++
+		return data, nil
+	}, func() ([]byte, *ObjectInfo, error) {
+		return nil, nil, nil
+	}, func([]byte, *ObjectInfo) (*ObjectInfo, error) {
+		return nil, ErrPreconditionFailed
+	})
+
+	if !errors.Is(err, ErrPreconditionFailed) || err == ErrPreconditionFailed {
+		t.Fatalf("conflicting update returned %v, want a wrapped ErrPreconditionFailed", err)
+	}
+
+	if calls != updateMaxAttempts {
+		t.Fatalf("conflicting update made %d attempts, want %d", calls, updateMaxAttempts)
+	}
+}
+
+func Test_GlobRegexp(t *testing.T) {
+	//the same table of matches is checked against the emulator's glob, which does not share the regexp translation
+	for _, tc := range []struct {
+		glob, name string
+		want       bool
+	}{
+		{"*.json", "a.json", true},
+		{"*.json", "a/b.json", false},
+		{"**.json", "a/b.json", true},
+		{"a/?.json", "a/b.json", true},
+		{"a/?.json", "a//.json", false},
+		{"[ab].txt", "b.txt", true},
+		{"[!ab].txt", "b.txt", false},
+		{"[]].txt", "].txt", true},
+		{"{x,y}/*", "y/z", true},
+		{"{x,y}/*", "w/z", false},
+		{"a.b", "axb", false},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{"a,b", "a,b", true},
+		{"[a-c]x", "bx", true},
+		{"[a-c]x", "dx", false},
+		{"?.txt", "é.txt", true},
+		{"**/*.json", "a/b/c.json", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "b/c", false},
+	} {
+		re, err := globRegexp(tc.glob)
+		if err != nil {
+			t.Fatalf("glob %q returned %v", tc.glob, err)
+		}
+
+		if got := re.MatchString(tc.name); got != tc.want {
+			t.Fatalf("glob %q matching %q returned %v, want %v", tc.glob, tc.name, got, tc.want)
+		}
+
+		match, err := fakeGlob(tc.glob)
+		if err != nil {
+			t.Fatalf("emulator glob %q returned %v", tc.glob, err)
+		}
+
+		if got := match(tc.name); got != tc.want {
+			t.Fatalf("emulator glob %q matching %q returned %v, want %v", tc.glob, tc.name, got, tc.want)
+		}
+	}
+
+	for _, glob := range []string{"[abc", "{a,b", "a}"} {
+		if _, err := globRegexp(glob); err != ErrInvalidGlob {
+			t.Fatalf("glob %q returned %v, want ErrInvalidGlob", glob, err)
+		}
+
+		if _, err := fakeGlob(glob); err != ErrInvalidGlob {
+			t.Fatalf("emulator glob %q returned %v, want ErrInvalidGlob", glob, err)
+		}
+	}
+}
+
+// allocBytes returns the number of bytes allocated while fn runs
+func allocBytes(t *testing.T, fn func()) uint64 {
+	t.Helper()
+
+	var before, after runtime.MemStats
+
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// seekNopCloser adds a no-op Close method to a seekable reader
+type seekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (seekNopCloser) Close() error {
+	return nil
+}
+
+// collectListing reads a listing channel until it is closed and returns the object names
+func collectListing(t *testing.T, c <-chan interface{}) []string {
+	t.Helper()
+
+	var names []string
+	for r := range c {
+		switch v := r.(type) {
+		case error:
+			t.Fatal(v)
+		case map[string]interface{}:
+			names = append(names, v[ObjAttrName].(string))
+		}
+	}
+
+	return names
+}
+
+// collectObjects reads a typed listing channel until it is closed, failing the test on any error
+func collectObjects(t *testing.T, c <-chan ObjectResult) []*ObjectInfo {
+	t.Helper()
+
+	var infos []*ObjectInfo
+	for res := range c {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		infos = append(infos, res.Object)
+	}
+
+	return infos
+}
+
+// checkListObjects checks the typed listing methods of a backend, and that the map listing agrees with them
+func checkListObjects(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	names := []string{"list/b/2.json", "list/a/1.json", "list/b/1.json", "list/c.json"}
+	for _, name := range names {
+		if err := sto.WriteBucketFile(ctx, bucketName, name, []byte(`{"name":"`+name+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	objs, err := sto.ListObjects(ctx, bucketName, "list/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos := collectObjects(t, objs)
+	if len(infos) != len(names) || infos[0].Name != "list/a/1.json" || infos[3].Name != "list/c.json" {
+		t.Fatalf("unexpected typed listing of %d objects", len(infos))
+	}
+
+	for _, info := range infos {
+		if info.Bucket != bucketName || info.Size != int64(len(`{"name":""}`)+len(info.Name)) || info.Created.IsZero() {
+			t.Fatalf("unexpected attributes %+v", info)
+		}
+	}
+
+	//the map listing carries the same objects
+	rfchn, err := sto.ListBucket(ctx, bucketName, "list/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := 0
+	for v := range rfchn {
+		at, ok := v.(map[string]interface{})
+		if !ok {
+			t.Fatalf("unexpected listing item %v", v)
+		}
+
+		if at[ObjAttrName] != infos[i].Name || at[ObjAttrSize] != infos[i].Size || at[ObjAttrCreated] != infos[i].Created.Unix() {
+			t.Fatalf("map listing %v does not match %+v", at, infos[i])
+		}
+		i++
+	}
+
+	if i != len(infos) {
+		t.Fatalf("map listing returned %d objects, want %d", i, len(infos))
+	}
+
+	//the time listing filters on the created time
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+
+	objs, err = sto.ListObjectsByTime(ctx, bucketName, "list/b/", &start, &end, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if infos := collectObjects(t, objs); len(infos) != 2 {
+		t.Fatalf("time listing returned %d objects, want 2", len(infos))
+	}
+
+	objs, err = sto.ListObjectsByTime(ctx, bucketName, "list/", &end, nil, 1)
+	if err != ErrMissingDateRange {
+		t.Fatalf("missing end date returned %v, want ErrMissingDateRange", err)
+	}
+}
+
+// checkObjects checks the listing iterator of a backend
+func checkObjects(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	names := []string{"iter/b.json", "iter/a.json", "iter/c.json", "other.json"}
+	for _, name := range names {
+		if err := sto.WriteBucketFile(ctx, bucketName, name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//pull the objects with Next
+	it := sto.Objects(ctx, bucketName, "iter/")
+
+	var got []string
+	for it.Next() {
+		got = append(got, it.Object().Name)
+	}
+
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(got, ",") != "iter/a.json,iter/b.json,iter/c.json" {
+		t.Fatalf("unexpected listing %v", got)
+	}
+
+	//a finished iterator stays finished
+	if it.Next() || it.Object() != nil {
+		t.Fatal("iterator advanced after the listing completed")
+	}
+
+	//range over the sequence, stopping early
+	got = nil
+	for info, err := range sto.Objects(ctx, bucketName, "iter/").All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, info.Name)
+		if len(got) == 2 {
+			break
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("early break listed %d objects, want 2", len(got))
+	}
+
+	//the iterator stops once the context is cancelled
+	cctx, cancel := context.WithCancel(ctx)
+
+	it = sto.Objects(cctx, bucketName, "iter/")
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+
+	cancel()
+
+	if it.Next() {
+		t.Fatal("iterator advanced after the context was cancelled")
+	}
+
+	if !errors.Is(it.Err(), context.Canceled) {
+		t.Fatalf("cancelled iterator returned %v, want context.Canceled", it.Err())
+	}
+
+	//the sequence yields the error last
+	var seqErr error
+	for _, err := range it.All() {
+		seqErr = err
+	}
+
+	if !errors.Is(seqErr, context.Canceled) {
+		t.Fatalf("cancelled sequence returned %v, want context.Canceled", seqErr)
+	}
+}
+
+// checkListPage checks the paged listing method of a backend
+func checkListPage(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for _, name := range []string{"page/4.json", "page/2.json", "page/5.json", "page/1.json", "page/3.json", "other.json"} {
+		if err := sto.WriteBucketFile(ctx, bucketName, name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//walk the pages, following the tokens
+	var names []string
+	var sizes []int
+
+	token := ""
+	for {
+		page, err := sto.ListPage(ctx, bucketName, "page/", 2, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sizes = append(sizes, len(page.Objects))
+		for _, info := range page.Objects {
+			names = append(names, info.Name)
+		}
+
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+
+	if fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Fatalf("unexpected page sizes %v", sizes)
+	}
+
+	if strings.Join(names, ",") != "page/1.json,page/2.json,page/3.json,page/4.json,page/5.json" {
+		t.Fatalf("unexpected paged listing %v", names)
+	}
+
+	//the default page size returns everything in one page
+	page, err := sto.ListPage(ctx, bucketName, "page/", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Objects) != 5 || page.NextPageToken != "" {
+		t.Fatalf("default page returned %d objects and token %q", len(page.Objects), page.NextPageToken)
+	}
+}
+
+// checkListDir checks the delimited listing method of a backend
+func checkListDir(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for _, name := range []string{"dir/sub1/x.json", "dir/b.json", "dir/sub2/z.json", "dir/a.json", "dir/sub1/y.json"} {
+		if err := sto.WriteBucketFile(ctx, bucketName, name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//objects come before the prefixes which sort after them, and each prefix is listed once
+	var objs, dirs []string
+
+	token := ""
+	for {
+		page, err := sto.ListDir(ctx, bucketName, "dir/", "/", 2, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, info := range page.Objects {
+			objs = append(objs, info.Name)
+		}
+		dirs = append(dirs, page.Prefixes...)
+
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+
+	if strings.Join(objs, ",") != "dir/a.json,dir/b.json" || strings.Join(dirs, ",") != "dir/sub1/,dir/sub2/" {
+		t.Fatalf("unexpected directory listing %v %v", objs, dirs)
+	}
+
+	//a deeper prefix lists the contents of the directory
+	page, err := sto.ListDir(ctx, bucketName, "dir/sub1/", "/", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Objects) != 2 || len(page.Prefixes) != 0 {
+		t.Fatalf("subdirectory listing returned %d objects and prefixes %v", len(page.Objects), page.Prefixes)
+	}
+
+	//without a delimiter every object is listed
+	page, err = sto.ListDir(ctx, bucketName, "dir/", "", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Objects) != 5 || len(page.Prefixes) != 0 {
+		t.Fatalf("undelimited listing returned %d objects and prefixes %v", len(page.Objects), page.Prefixes)
+	}
+}
+
+// checkListObjectsQuery checks the query listing methods of a backend
+func checkListObjectsQuery(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for _, name := range []string{"q/1.json", "q/2.json", "q/3.json"} {
+		if err := sto.WriteBucketFile(ctx, bucketName, name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	//take the timestamps as the backend lists them
+	infos := collectObjects(t, mustList(t, sto, bucketName, &ListQuery{Prefix: "q/"}))
+	if len(infos) != 3 {
+		t.Fatalf("query listing returned %d objects, want 3", len(infos))
+	}
+
+	t1, t2, t3 := infos[0].Created, infos[1].Created, infos[2].Created
+
+	for _, tc := range []struct {
+		q    *ListQuery
+		want string
+	}{
+		{&ListQuery{Prefix: "q/", Created: &TimeRange{Start: t1, End: t3}}, "q/2.json"},
+		{&ListQuery{Prefix: "q/", Created: &TimeRange{Start: t1, End: t3, IncludeStart: true, IncludeEnd: true}}, "q/1.json,q/2.json,q/3.json"},
+		{&ListQuery{Prefix: "q/", Created: &TimeRange{Start: t2, IncludeStart: true}}, "q/2.json,q/3.json"},
+		{&ListQuery{Prefix: "q/", Created: &TimeRange{End: t2}}, "q/1.json"},
+		{&ListQuery{Prefix: "q/", Updated: &TimeRange{Start: infos[2].Updated, IncludeStart: true}}, "q/3.json"},
+		{&ListQuery{Prefix: "q/", StartOffset: "q/2", EndOffset: "q/3"}, "q/2.json"},
+		{&ListQuery{StartOffset: "q/", EndOffset: "q/2"}, "q/1.json"},
+	} {
+		var names []string
+		for _, info := range collectObjects(t, mustList(t, sto, bucketName, tc.q)) {
+			names = append(names, info.Name)
+		}
+
+		if got := strings.Join(names, ","); got != tc.want {
+			t.Fatalf("query %+v returned %q, want %q", tc.q, got, tc.want)
+		}
+	}
+
+	//the iterator and map listing apply the same query
+	it := sto.QueryObjects(ctx, bucketName, &ListQuery{Prefix: "q/", Created: &TimeRange{Start: t1}})
+
+	n := 0
+	for it.Next() {
+		n++
+	}
+
+	if it.Err() != nil || n != 2 {
+		t.Fatalf("query iterator returned %d objects and %v, want 2", n, it.Err())
+	}
+
+	rfchn, err := sto.ListBucketQuery(ctx, bucketName, &ListQuery{Prefix: "q/", Created: &TimeRange{End: t3}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 2 {
+		t.Fatalf("map query listing returned %v", names)
+	}
+}
+
+// checkListFilters checks the glob, regular expression and predicate filters of a backend
+func checkListFilters(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for _, name := range []string{
+		"reports/2023-12/summary.json",
+		"reports/2024-01/summary.json",
+		"reports/2024-02/detail.json",
+		"reports/2024-02/summary.json",
+		"reports/2024-03/x/summary.json",
+	} {
+		if err := sto.WriteBucketFile(ctx, bucketName, name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		q    *ListQuery
+		want int
+	}{
+		{&ListQuery{MatchGlob: "reports/2024-*/summary.json"}, 2},
+		{&ListQuery{MatchGlob: "reports/**/summary.json"}, 4},
+		{&ListQuery{MatchGlob: "reports/{2023-12,2024-01}/summary.json"}, 2},
+		{&ListQuery{Prefix: "reports/", MatchGlob: "reports/2024-0[!1]/*.json"}, 2},
+		{&ListQuery{Prefix: "reports/", Regexp: regexp.MustCompile(`/20\d\d-\d\d/detail\.json$`)}, 1},
+		{&ListQuery{Prefix: "reports/", Filter: func(info *ObjectInfo) bool { return strings.Contains(info.Name, "2023") }}, 1},
+		{&ListQuery{MatchGlob: "reports/2024-*/*.json", Regexp: regexp.MustCompile("summary")}, 2},
+	} {
+		if infos := collectObjects(t, mustList(t, sto, bucketName, tc.q)); len(infos) != tc.want {
+			t.Fatalf("query %+v returned %d objects, want %d", tc.q, len(infos), tc.want)
+		}
+	}
+
+	//the map listing applies the same filters
+	rfchn, err := sto.ListBucketQuery(ctx, bucketName, &ListQuery{MatchGlob: "reports/2024-*/summary.json"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := collectListing(t, rfchn); len(names) != 2 {
+		t.Fatalf("map glob listing returned %v", names)
+	}
+
+	//invalid patterns are rejected
+	if _, err := sto.ListObjectsQuery(ctx, bucketName, &ListQuery{MatchGlob: "reports/[abc"}, 1); err != ErrInvalidGlob {
+		t.Fatalf("invalid glob returned %v, want ErrInvalidGlob", err)
+	}
+
+	it := sto.QueryObjects(ctx, bucketName, &ListQuery{MatchGlob: "reports/{a"})
+	if it.Next() || it.Err() != ErrInvalidGlob {
+		t.Fatalf("invalid glob iterator returned %v, want ErrInvalidGlob", it.Err())
+	}
+}
+
+// mustList starts a query listing, failing the test on error
+func mustList(t *testing.T, sto capabilities, bucketName string, q *ListQuery) <-chan ObjectResult {
+	t.Helper()
+
+	objs, err := sto.ListObjectsQuery(context.Background(), bucketName, q, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return objs
+}
+
+// waitGoroutines waits for the number of running goroutines to fall to n, failing the test if it does not
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running, want %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkListingCancel checks that the channel listings of a backend stop once the context is cancelled, both when the
+// consumer has abandoned a full channel and when an error is waiting to be sent
+func checkListingCancel(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for i := range 10 {
+		if err := sto.WriteBucketFile(ctx, bucketName, fmt.Sprintf("leak/%d.json", i), []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+
+	before := runtime.NumGoroutine()
+
+	for _, list := range []func(context.Context) (int, error){
+		func(ctx context.Context) (int, error) {
+			c, err := sto.ListBucket(ctx, bucketName, "leak/", 1)
+			if err != nil {
+				return 0, err
+			}
+			<-c
+			return len(c), nil
+		},
+		func(ctx context.Context) (int, error) {
+			c, err := sto.ListBucketByTime(ctx, bucketName, "leak/", &start, &end, 1)
+			if err != nil {
+				return 0, err
+			}
+			<-c
+			return len(c), nil
+		},
+		func(ctx context.Context) (int, error) {
+			c, err := sto.ListObjects(ctx, bucketName, "leak/", 0)
+			if err != nil {
+				return 0, err
+			}
+			<-c
+			return len(c), nil
+		},
+	} {
+		//read a single item, leaving the producer blocked on a full channel
+		cctx, cancel := context.WithCancel(ctx)
+
+		if _, err := list(cctx); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+
+		waitGoroutines(t, before)
+	}
+}
+
+// checkStreamBucketFile checks the streaming read methods of a backend
+func checkStreamBucketFile(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	dat := bytes.Repeat([]byte("0123456789"), 10000)
+
+	if err := sto.WriteBucketFile(ctx, bucketName, "stream.bin", dat); err != nil {
+		t.Fatal(err)
+	}
+
+	//read through the reader
+	rc, err := sto.GetBucketFileReader(ctx, bucketName, "stream.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, dat) {
+		t.Fatalf("reader returned %d bytes, want %d", len(got), len(dat))
+	}
+
+	//copy into a writer
+	var buf bytes.Buffer
+	n, err := sto.StreamBucketFile(ctx, bucketName, "stream.bin", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(dat)) || !bytes.Equal(buf.Bytes(), dat) {
+		t.Fatalf("stream copied %d bytes, want %d", n, len(dat))
+	}
+
+	//missing objects fail as GetBucketFileData does
+	_, err = sto.GetBucketFileReader(ctx, bucketName, "missing.bin")
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("reader for missing object returned %v, want ErrObjectNotExist", err)
+	}
+
+	_, err = sto.StreamBucketFile(ctx, bucketName, "missing.bin", &buf)
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("stream of missing object returned %v, want ErrObjectNotExist", err)
+	}
+
+	//reads stop once the context is cancelled
+	cctx, cancel := context.WithCancel(ctx)
+
+	rc, err = sto.GetBucketFileReader(cctx, bucketName, "stream.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	if _, err := rc.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	if _, err := io.ReadAll(rc); !errors.Is(err, context.Canceled) {
+		t.Fatalf("read after cancel returned %v, want context.Canceled", err)
+	}
+}
+
+// checkStat checks the attribute read method of a backend
+func checkStat(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	dat := []byte(`{"stat":true}`)
+
+	written, err := sto.WriteBucketFileFrom(ctx, bucketName, "stat/obj.json", bytes.NewReader(dat), &WriteOptions{
+		ContentType:     "application/json",
+		ContentEncoding: "identity",
+		Metadata:        map[string]string{"team": "storage"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := sto.Stat(ctx, bucketName, "stat/obj.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := md5.Sum(dat)
+
+	switch {
+	case info.Bucket != bucketName || info.Name != "stat/obj.json":
+		t.Fatalf("unexpected name %s/%s", info.Bucket, info.Name)
+	case info.Size != int64(len(dat)):
+		t.Fatalf("size is %d, want %d", info.Size, len(dat))
+	case info.ContentType != "application/json" || info.ContentEncoding != "identity":
+		t.Fatalf("unexpected content type %q and encoding %q", info.ContentType, info.ContentEncoding)
+	case info.Metadata["team"] != "storage":
+		t.Fatalf("unexpected metadata %v", info.Metadata)
+	case !bytes.Equal(info.MD5, sum[:]):
+		t.Fatalf("md5 is %x, want %x", info.MD5, sum)
+	case info.CRC32C != 0 && info.CRC32C != crc32.Checksum(dat, crc32cTable):
+		t.Fatalf("crc32c is %x, want %x", info.CRC32C, crc32.Checksum(dat, crc32cTable))
+	case info.Generation != written.Generation:
+		t.Fatalf("generation is %d, want %d", info.Generation, written.Generation)
+	case info.Created.IsZero() || info.Updated.IsZero():
+		t.Fatalf("missing timestamps %v %v", info.Created, info.Updated)
+	}
+
+	//missing objects, including names which are only a prefix of other objects, are not found
+	for _, name := range []string{"stat/missing.json", "stat"} {
+		if _, err := sto.Stat(ctx, bucketName, name); !errors.Is(err, storage.ErrObjectNotExist) {
+			t.Fatalf("stat of %q returned %v, want ErrObjectNotExist", name, err)
+		}
+	}
+}
+
+// checkGetBucketFileRange checks the ranged read method of a backend
+func checkGetBucketFileRange(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	dat := []byte("0123456789abcdefghij")
+
+	if err := sto.WriteBucketFile(ctx, bucketName, "range.txt", dat); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, string(dat)},
+		{0, 5, "01234"},
+		{5, 5, "56789"},
+		{15, -1, "fghij"},
+		{15, 100, "fghij"},
+		{-4, -1, "ghij"},
+		{-100, -1, string(dat)},
+		{3, 0, ""},
+	} {
+		rc, err := sto.GetBucketFileRange(ctx, bucketName, "range.txt", tc.offset, tc.length)
+		if err != nil {
+			t.Fatalf("range %d,%d returned %v", tc.offset, tc.length, err)
+		}
+
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != tc.want {
+			t.Fatalf("range %d,%d returned %q, want %q", tc.offset, tc.length, got, tc.want)
+		}
+	}
+
+	//ranges which cannot be satisfied are rejected
+	_, err := sto.GetBucketFileRange(ctx, bucketName, "range.txt", 50, -1)
+	if !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("range past the end returned %v, want ErrInvalidRange", err)
+	}
+
+	_, err = sto.GetBucketFileRange(ctx, bucketName, "range.txt", -4, 2)
+	if !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("negative offset with a length returned %v, want ErrInvalidRange", err)
+	}
+
+	_, err = sto.GetBucketFileRange(ctx, bucketName, "missing.txt", 0, 5)
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("range of missing object returned %v, want ErrObjectNotExist", err)
+	}
+}
+
+// checkWriteBucketFileFrom checks the streaming write method of a backend
+func checkWriteBucketFileFrom(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	//write enough data to need several chunks
+	dat := bytes.Repeat([]byte("abcdefghijklmnopqrstuvwxyz012345"), (11<<20)/32)
+
+	opts := &WriteOptions{
+		ChunkSize:       5 << 20,
+		ContentType:     "application/x-storage-test",
+		ContentEncoding: "identity",
+		Metadata:        map[string]string{"team": "storage"},
+	}
+
+	info, err := sto.WriteBucketFileFrom(ctx, bucketName, "large.bin", bytes.NewReader(dat), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := md5.Sum(dat)
+
+	if info.Name != "large.bin" || info.Size != int64(len(dat)) || !bytes.Equal(info.MD5, sum[:]) {
+		t.Fatalf("unexpected attributes %+v", info)
+	}
+
+	if info.CRC32C != crc32.Checksum(dat, crc32cTable) {
+		t.Fatalf("unexpected crc32c %d", info.CRC32C)
+	}
+
+	if info.ContentType != opts.ContentType || info.ContentEncoding != opts.ContentEncoding || info.Metadata["team"] != "storage" {
+		t.Fatalf("unexpected attributes %+v", info)
+	}
+
+	if info.Created.IsZero() {
+		t.Fatal("created time not set")
+	}
+
+	got, err := sto.GetBucketFileData(ctx, bucketName, "large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, dat) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(dat))
+	}
+
+	//small writes with no options should detect the content type
+	info, err = sto.WriteBucketFileFrom(ctx, bucketName, "small.json", strings.NewReader(`{"a":1}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size != 7 || info.ContentType == "" {
+		t.Fatalf("unexpected attributes %+v", info)
+	}
+
+	//a failing reader should not leave an object behind
+	_, err = sto.WriteBucketFileFrom(ctx, bucketName, "failed.bin", io.MultiReader(bytes.NewReader(dat), iotest.ErrReader(errTestRead)), opts)
+	if err == nil {
+		t.Fatal("write from failing reader succeeded")
+	}
+
+	if _, err := sto.GetBucketFileData(ctx, bucketName, "failed.bin"); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("read of failed write returned %v, want ErrObjectNotExist", err)
+	}
+}
+
+func Test_ClassifyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"object not exist", storage.ErrObjectNotExist, ErrNotFound},
+		{"bucket not exist", storage.ErrBucketNotExist, ErrNotFound},
+		{"fs not exist", &fs.PathError{Op: "open", Path: "x", Err: fs.ErrNotExist}, ErrNotFound},
+		{"fs exist", &fs.PathError{Op: "mkdir", Path: "x", Err: fs.ErrExist}, ErrAlreadyExists},
+		{"fs permission", &fs.PathError{Op: "open", Path: "x", Err: fs.ErrPermission}, ErrPermissionDenied},
+		{"no space", &fs.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, ErrQuotaExceeded},
+		{"gcs not found", &googleapi.Error{Code: http.StatusNotFound}, ErrNotFound},
+		{"gcs conflict", &googleapi.Error{Code: http.StatusConflict}, ErrAlreadyExists},
+		{"gcs precondition", &googleapi.Error{Code: http.StatusPreconditionFailed}, ErrPreconditionFailed},
+		{"gcs not modified", &googleapi.Error{Code: http.StatusNotModified}, ErrPreconditionFailed},
+		{"gcs unauthorized", &googleapi.Error{Code: http.StatusUnauthorized}, ErrPermissionDenied},
+		{"gcs forbidden", &googleapi.Error{Code: http.StatusForbidden}, ErrPermissionDenied},
+		{"gcs too many requests", &googleapi.Error{Code: http.StatusTooManyRequests}, ErrQuotaExceeded},
+		{"gcs rate limit", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, ErrQuotaExceeded},
+		{"s3 no such key", &S3Error{StatusCode: http.StatusNotFound, Code: "NoSuchKey"}, ErrNotFound},
+		{"s3 bucket exists", &S3Error{StatusCode: http.StatusConflict, Code: "BucketAlreadyOwnedByYou"}, ErrAlreadyExists},
+		{"s3 precondition", &S3Error{StatusCode: http.StatusPreconditionFailed, Code: "PreconditionFailed"}, ErrPreconditionFailed},
+		{"s3 access denied", &S3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied"}, ErrPermissionDenied},
+		{"s3 slow down", &S3Error{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown"}, ErrQuotaExceeded},
+		{"wrapped", fmt.Errorf("reading: %w", &googleapi.Error{Code: http.StatusNotFound}), ErrNotFound},
+		{"server error", &googleapi.Error{Code: http.StatusInternalServerError}, nil},
+		{"cancelled", context.Canceled, nil},
+		{"nil", nil, nil},
+	}
+
+	kinds := []error{ErrNotFound, ErrAlreadyExists, ErrPreconditionFailed, ErrPermissionDenied, ErrQuotaExceeded}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classify(tt.err)
+
+			if tt.want == nil {
+				if err != tt.err {
+					t.Fatalf("classify returned %v, want the error unchanged", err)
+				}
+				return
+			}
+
+			for _, kind := range kinds {
+				if errors.Is(err, kind) != (kind == tt.want) {
+					t.Fatalf("errors.Is(%v, %v) is %v", err, kind, !(kind == tt.want))
+				}
+			}
+
+			//the backend error remains reachable
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("classified error %v does not match %v", err, tt.err)
+			}
+
+			var se *Error
+			if !errors.As(err, &se) || se.Kind != tt.want {
+				t.Fatalf("classified error %v is not an *Error of kind %v", err, tt.want)
+			}
+
+			if err.Error() != tt.err.Error() {
+				t.Fatalf("message is %q, want %q", err.Error(), tt.err.Error())
+			}
+
+			//classifying twice does not wrap again
+			if classify(err) != err {
+				t.Fatal("classify wrapped an already classified error")
+			}
+		})
+	}
+}
+
+// checkErrors checks that a backend reports missing objects as ErrNotFound
+func checkErrors(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	name := "errors/missing.txt"
+
+	_, err := sto.GetBucketFileData(ctx, bucketName, name)
+	checkNotFound(t, "read", err)
+
+	_, err = sto.GetBucketFileReader(ctx, bucketName, name)
+	checkNotFound(t, "reader", err)
+
+	_, err = sto.GetBucketFileRange(ctx, bucketName, name, 0, 1)
+	checkNotFound(t, "range", err)
+
+	_, err = sto.StreamBucketFile(ctx, bucketName, name, io.Discard)
+	checkNotFound(t, "stream", err)
+
+	_, err = sto.Stat(ctx, bucketName, name)
+	checkNotFound(t, "stat", err)
+
+	err = sto.RemoveFile(ctx, bucketName, name)
+	if conditionalDeletes(sto) {
+		checkNotFound(t, "remove", err)
+	} else if err != nil {
+		t.Fatalf("unconditional remove of missing object returned %v", err)
+	}
+
+	//errors which are not backend failures are returned unchanged
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := sto.Stat(cctx, bucketName, name); !errors.Is(err, context.Canceled) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("stat with cancelled context returned %v, want context.Canceled", err)
+	}
+}
+
+// checkNotFound checks that err is ErrNotFound, and still matches the storage error it was mapped from
+func checkNotFound(t *testing.T, op string, err error) {
+	t.Helper()
+
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("%s of missing object returned %v, want ErrNotFound", op, err)
+	}
+
+	if !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Fatalf("%s of missing object returned %v, want ErrObjectNotExist", op, err)
+	}
+
+	var se *Error
+	if !errors.As(err, &se) || se.Kind != ErrNotFound {
+		t.Fatalf("%s of missing object returned %v, want an *Error", op, err)
+	}
+}
+
+// checkConditions checks the does not exist condition of a backend's conditional writes, and the validation of
+// conditions
+func checkConditions(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	name := "cond/create.json"
+
+	if _, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte(`{"v":1}`), &Conditions{DoesNotExist: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte(`{"v":2}`), &Conditions{DoesNotExist: true})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("create of existing object returned %v, want ErrPreconditionFailed", err)
+	}
+
+	//streamed writes take their conditions from the options
+	_, err = sto.WriteBucketFileFrom(ctx, bucketName, name, bytes.NewReader(make([]byte, 600<<10)), &WriteOptions{
+		ChunkSize:  256 << 10,
+		Conditions: &Conditions{DoesNotExist: true},
+	})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("streamed create of existing object returned %v, want ErrPreconditionFailed", err)
+	}
+
+	if dat, err := sto.GetBucketFileData(ctx, bucketName, name); err != nil || string(dat) != `{"v":1}` {
+		t.Fatalf("object holds %q, %v after failed writes", dat, err)
+	}
+
+	//no conditions is an unconditional write
+	if _, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte(`{"v":3}`), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sto.WriteBucketFileIf(ctx, bucketName, name, nil, &Conditions{DoesNotExist: true, GenerationMatch: 1}); !errors.Is(err, ErrInvalidConditions) {
+		t.Fatalf("write with conflicting conditions returned %v, want ErrInvalidConditions", err)
+	}
+
+	if err := sto.RemoveFileIf(ctx, bucketName, name, &Conditions{DoesNotExist: true}); !errors.Is(err, ErrInvalidConditions) {
+		t.Fatalf("delete if not exists returned %v, want ErrInvalidConditions", err)
+	}
+
+	if err := sto.RemoveFileIf(ctx, bucketName, name, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkGenerationConditions checks the generation and metageneration conditions of a backend's conditional writes and
+// deletes
+func checkGenerationConditions(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	name := "cond/state.json"
+
+	if _, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte("v1"), &Conditions{GenerationMatch: 1}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("generation match on missing object returned %v, want ErrPreconditionFailed", err)
+	}
+
+	first, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte("v1"), &Conditions{DoesNotExist: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte("v2"), &Conditions{GenerationMatch: first.Generation})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.Generation == first.Generation {
+		t.Fatalf("write kept generation %d", first.Generation)
+	}
+
+	//a writer which read the first generation has lost the race
+	if _, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte("stale"), &Conditions{GenerationMatch: first.Generation}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("write with stale generation returned %v, want ErrPreconditionFailed", err)
+	}
+
+	if _, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte("stale"), &Conditions{MetagenerationMatch: second.Metageneration + 1}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("write with wrong metageneration returned %v, want ErrPreconditionFailed", err)
+	}
+
+	if dat, err := sto.GetBucketFileData(ctx, bucketName, name); err != nil || string(dat) != "v2" {
+		t.Fatalf("object holds %q, %v after failed writes", dat, err)
+	}
+
+	third, err := sto.WriteBucketFileIf(ctx, bucketName, name, []byte("v3"), &Conditions{
+		GenerationMatch:     second.Generation,
+		MetagenerationMatch: second.Metageneration,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sto.RemoveFileIf(ctx, bucketName, name, &Conditions{GenerationMatch: second.Generation}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("delete with stale generation returned %v, want ErrPreconditionFailed", err)
+	}
+
+	if _, err := sto.Stat(ctx, bucketName, name); err != nil {
+		t.Fatalf("object missing after failed delete: %v", err)
+	}
+
+	if err := sto.RemoveFileIf(ctx, bucketName, name, &Conditions{GenerationMatch: third.Generation}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sto.RemoveFileIf(ctx, bucketName, name, &Conditions{GenerationMatch: third.Generation}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("delete of missing object returned %v, want ErrNotFound", err)
+	}
+}
+
+// checkUpdate checks the read-modify-write method of a backend
+func checkUpdate(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	name := "update/counter.txt"
+
+	increment := func(data []byte) ([]byte, error) {
+		n := 0
+		if data != nil {
+			var err error
+			if n, err = strconv.Atoi(string(data)); err != nil {
+				return nil, err
+			}
+		}
+
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+
+	//a missing object is created
+	if _, err := sto.Update(ctx, bucketName, name, increment); err != nil {
+		t.Fatal(err)
+	}
+
+	//concurrent updates are all applied
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 5 {
+				if _, err := sto.Update(ctx, bucketName, name, increment); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if dat, err := sto.GetBucketFileData(ctx, bucketName, name); err != nil || string(dat) != "21" {
+		t.Fatalf("counter is %q, %v, want 21", dat, err)
+	}
+
+	//a write between the read and the write back makes the update start again from the new data
+	docOpts := &WriteOptions{
+		ContentType: "application/json",
+		Metadata:    map[string]string{"team": "storage"},
+	}
+
+	if _, err := sto.WriteBucketFileFrom(ctx, bucketName, "update/doc.json", strings.NewReader(`{"n":1}`), docOpts); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	updated, err := sto.Update(ctx, bucketName, "update/doc.json", func(data []byte) ([]byte, error) {
+		seen = append(seen, string(data))
+		if len(seen) == 1 {
+			if _, err := sto.WriteBucketFileFrom(ctx, bucketName, "update/doc.json", strings.NewReader(`{"n":2}`), docOpts); err != nil {
+				return nil, err
+			}
+		}
+		return bytes.Replace(data, []byte("}"), []byte(`,"u":true}`), 1), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != 2 || seen[0] != `{"n":1}` || seen[1] != `{"n":2}` {
+		t.Fatalf("update saw %q", seen)
+	}
+
+	if dat, err := sto.GetBucketFileData(ctx, bucketName, "update/doc.json"); err != nil || string(dat) != `{"n":2,"u":true}` {
+		t.Fatalf("updated object holds %q, %v", dat, err)
+	}
+
+	//the object keeps the attributes which it had when it was read
+	info, err := sto.Stat(ctx, bucketName, "update/doc.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.ContentType != "application/json" || info.Metadata["team"] != "storage" || updated.Size != info.Size {
+		t.Fatalf("unexpected attributes %+v", info)
+	}
+
+	//errors from the mutation abandon the update
+	errStop := errors.New("stop")
+	if _, err := sto.Update(ctx, bucketName, name, func([]byte) ([]byte, error) { return nil, errStop }); !errors.Is(err, errStop) {
+		t.Fatalf("update returned %v, want the mutation error", err)
+	}
+
+	if dat, err := sto.GetBucketFileData(ctx, bucketName, name); err != nil || string(dat) != "21" {
+		t.Fatalf("counter is %q, %v after abandoned update, want 21", dat, err)
+	}
+
+	//an update which keeps conflicting ends with the context
+	cctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	_, err = sto.Update(cctx, bucketName, "update/busy.txt", func(data []byte) ([]byte, error) {
+		busy := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+		if _, err := sto.WriteBucketFileData(ctx, bucketName, "update/busy.txt", busy); err != nil {
+			return nil, err
+		}
+		return data, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("conflicting update returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// checkUpdateEncoded checks that updates of gzip-encoded objects see and write back the stored bytes
+func checkUpdateEncoded(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	name := "update/doc.json.gz"
+
+	gz := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	first, second := gz(`{"n":1}`), gz(`{"n":2}`)
+
+	opts := &WriteOptions{ContentType: "application/json", ContentEncoding: "gzip"}
+	if _, err := sto.WriteBucketFileFrom(ctx, bucketName, name, bytes.NewReader(first), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []byte
+	updated, err := sto.Update(ctx, bucketName, name, func(data []byte) ([]byte, error) {
+		seen = data
+		return second, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(seen, first) {
+		t.Fatalf("update saw %q, want the compressed object %q", seen, first)
+	}
+
+	info, err := sto.Stat(ctx, bucketName, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.ContentEncoding != "gzip" || info.Size != int64(len(second)) || updated.Size != info.Size {
+		t.Fatalf("updated object has attributes %+v, want %d gzip bytes", info, len(second))
+	}
+}
+
+// checkCopyMove checks the copy and move methods of a backend, within a bucket and into otherBucket
+func checkCopyMove(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	dat := []byte(`{"copy":true}`)
+
+	src, err := sto.WriteBucketFileFrom(ctx, bucketName, "copy/src.json", bytes.NewReader(dat), &WriteOptions{
+		ContentType: "application/json",
+		Metadata:    map[string]string{"team": "storage"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkCopy := func(info *ObjectInfo, bucket, name string) {
+		t.Helper()
+
+		switch {
+		case info.Bucket != bucket || info.Name != name:
+			t.Fatalf("copy is %s/%s, want %s/%s", info.Bucket, info.Name, bucket, name)
+		case info.Size != int64(len(dat)) || !bytes.Equal(info.MD5, src.MD5):
+			t.Fatalf("copy has size %d and md5 %x, want %d and %x", info.Size, info.MD5, len(dat), src.MD5)
+		}
+
+		stat, err := sto.Stat(ctx, bucket, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stat.ContentType != "application/json" || stat.Metadata["team"] != "storage" {
+			t.Fatalf("copy has content type %q and metadata %v", stat.ContentType, stat.Metadata)
+		}
+
+		if got, err := sto.GetBucketFileData(ctx, bucket, name); err != nil || !bytes.Equal(got, dat) {
+			t.Fatalf("copy holds %q, %v", got, err)
+		}
+	}
+
+	info, err := sto.Copy(ctx, bucketName, "copy/src.json", bucketName, "copy/dst.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCopy(info, bucketName, "copy/dst.json")
+
+	info, err = sto.Copy(ctx, bucketName, "copy/src.json", testOtherBucket, "copy/dst.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCopy(info, testOtherBucket, "copy/dst.json")
+
+	//copies leave the source in place
+	if _, err := sto.Stat(ctx, bucketName, "copy/src.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	//a backend which cannot guard the delete refuses to move, and leaves the source in place
+	if !conditionalDeletes(sto) {
+		if _, err := sto.Move(ctx, bucketName, "copy/src.json", testOtherBucket, "copy/moved.json"); !errors.Is(err, ErrUnsupportedCondition) {
+			t.Fatalf("unguarded move returned %v, want ErrUnsupportedCondition", err)
+		}
+
+		if _, err := sto.Stat(ctx, testOtherBucket, "copy/moved.json"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("stat of refused move destination returned %v, want ErrNotFound", err)
+		}
+
+		checkCopy(src, bucketName, "copy/src.json")
+		return
+	}
+
+	info, err = sto.Move(ctx, bucketName, "copy/src.json", testOtherBucket, "copy/moved.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCopy(info, testOtherBucket, "copy/moved.json")
+
+	if _, err := sto.Stat(ctx, bucketName, "copy/src.json"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stat of moved object returned %v, want ErrNotFound", err)
+	}
+
+	//moving an object onto itself leaves it in place
+	if _, err := sto.Move(ctx, testOtherBucket, "copy/moved.json", testOtherBucket, "copy/moved.json"); err != nil {
+		t.Fatal(err)
+	}
+	checkCopy(info, testOtherBucket, "copy/moved.json")
+
+	if _, err := sto.Copy(ctx, bucketName, "copy/missing.json", bucketName, "copy/x.json"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("copy of missing object returned %v, want ErrNotFound", err)
+	}
+
+	if _, err := sto.Move(ctx, bucketName, "copy/missing.json", bucketName, "copy/x.json"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("move of missing object returned %v, want ErrNotFound", err)
+	}
+}
+
+// checkCompose checks the compose method of a backend, with more sources than can be composed at once
+func checkCompose(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	var names []string
+	var want []byte
+
+	for i := range 70 {
+		name := fmt.Sprintf("compose/part-%03d", i)
+		part := fmt.Appendf(nil, "%03d,", i)
+
+		if err := sto.WriteBucketFile(ctx, bucketName, name, part); err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, name)
+		want = append(want, part...)
+	}
+
+	info, err := sto.Compose(ctx, bucketName, "compose/all.csv", names, &ComposeOptions{
+		ContentType: "text/csv",
+		Metadata:    map[string]string{"team": "storage"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name != "compose/all.csv" || info.Size != int64(len(want)) {
+		t.Fatalf("composed object is %s of %d bytes, want %d bytes", info.Name, info.Size, len(want))
+	}
+
+	if got, err := sto.GetBucketFileData(ctx, bucketName, "compose/all.csv"); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("composed object holds %q, %v, want %q", got, err, want)
+	}
+
+	stat, err := sto.Stat(ctx, bucketName, "compose/all.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.ContentType != "text/csv" || stat.Metadata["team"] != "storage" {
+		t.Fatalf("composed object has content type %q and metadata %v", stat.ContentType, stat.Metadata)
+	}
+
+	//the intermediate objects are removed, and the sources kept
+	if objs := collectObjects(t, mustList(t, sto, bucketName, &ListQuery{Prefix: "compose/"})); len(objs) != len(names)+1 {
+		t.Fatalf("compose left %d objects, want %d", len(objs), len(names)+1)
+	}
+
+	//the sources can be deleted once they have been composed, where the backend can guard the deletes
+	_, err = sto.Compose(ctx, bucketName, "compose/head.csv", names[:3], &ComposeOptions{DeleteSources: true})
+	if !conditionalDeletes(sto) {
+		if !errors.Is(err, ErrUnsupportedCondition) {
+			t.Fatalf("unguarded compose deleting sources returned %v, want ErrUnsupportedCondition", err)
+		}
+
+		//the refused compose writes nothing, so the same objects can be composed and removed as the rest expects
+		if _, err := sto.Compose(ctx, bucketName, "compose/head.csv", names[:3], nil); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range names[:3] {
+			if err := sto.RemoveFile(ctx, bucketName, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := sto.GetBucketFileData(ctx, bucketName, "compose/head.csv"); err != nil || string(got) != "000,001,002," {
+		t.Fatalf("composed object holds %q, %v", got, err)
+	}
+
+	for _, name := range names[:3] {
+		if _, err := sto.Stat(ctx, bucketName, name); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("stat of composed source %s returned %v, want ErrNotFound", name, err)
+		}
+	}
+
+	//a missing source fails the compose, and still removes the intermediate objects
+	_, err = sto.Compose(ctx, bucketName, "compose/missing.csv", append(names[3:], "compose/missing"), nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("compose with missing source returned %v, want ErrNotFound", err)
+	}
+
+	if objs := collectObjects(t, mustList(t, sto, bucketName, &ListQuery{Prefix: "compose/"})); len(objs) != len(names)-3+2 {
+		t.Fatalf("failed compose left %d objects, want %d", len(objs), len(names)-3+2)
+	}
+
+	if _, err := sto.Compose(ctx, bucketName, "compose/none.csv", nil, nil); !errors.Is(err, ErrMissingSources) {
+		t.Fatalf("compose without sources returned %v, want ErrMissingSources", err)
+	}
+}
+
+// checkRemoveObjects checks the batch delete of a backend
+func checkRemoveObjects(t *testing.T, sto capabilities, bucketName string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for i := 1; i <= 5; i++ {
+		if err := sto.WriteBucketFile(ctx, bucketName, fmt.Sprintf("rm/%d.json", i), []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	infos := collectObjects(t, mustList(t, sto, bucketName, &ListQuery{Prefix: "rm/"}))
+	if len(infos) != 5 {
+		t.Fatalf("listing returned %d objects, want 5", len(infos))
+	}
+
+	start, end := infos[0].Created, infos[4].Created
+
+	//names lists the results, with the objects which were deleted marked
+	names := func(results []RemoveResult) string {
+		var s []string
+		for _, res := range results {
+			if res.Deleted {
+				s = append(s, res.Name+"!")
+			} else {
+				s = append(s, res.Name)
+			}
+		}
+		return strings.Join(s, ",")
+	}
+
+	remaining := func() string {
+		var s []string
+		for _, info := range collectObjects(t, mustList(t, sto, bucketName, &ListQuery{Prefix: "rm/"})) {
+			s = append(s, info.Name)
+		}
+		return strings.Join(s, ",")
+	}
+
+	for _, opts := range []*RemoveOptions{nil, {}, {Names: []string{}}} {
+		if _, err := sto.RemoveObjects(ctx, bucketName, opts); !errors.Is(err, ErrMissingObjects) {
+			t.Fatalf("remove with options %+v returned %v, want ErrMissingObjects", opts, err)
+		}
+	}
+
+	if _, err := sto.RemoveObjects(ctx, bucketName, &RemoveOptions{Prefix: "rm/", Start: &start}); !errors.Is(err, ErrMissingDateRange) {
+		t.Fatalf("remove with only a start returned %v, want ErrMissingDateRange", err)
+	}
+
+	//a dry run reports the objects without deleting them
+	results, err := sto.RemoveObjects(ctx, bucketName, &RemoveOptions{Prefix: "rm/", Start: &start, End: &end, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := names(results); got != "rm/2.json,rm/3.json,rm/4.json" {
+		t.Fatalf("dry run by prefix reported %s", got)
+	}
+
+	for _, res := range results {
+		if res.Err != nil || res.Object == nil || res.Object.Name != res.Name {
+			t.Fatalf("dry run reported %+v", res)
+		}
+	}
+
+	results, err = sto.RemoveObjects(ctx, bucketName, &RemoveOptions{Names: []string{"rm/1.json", "rm/missing"}, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0].Err != nil || results[0].Object == nil || results[0].Deleted {
+		t.Fatalf("dry run by name reported %+v", results)
+	}
+	checkNotFound(t, "dry run remove", results[1].Err)
+
+	if got := remaining(); got != "rm/1.json,rm/2.json,rm/3.json,rm/4.json,rm/5.json" {
+		t.Fatalf("dry run left %s", got)
+	}
+
+	//named objects outside the time range are left out of the results
+	results, err = sto.RemoveObjects(ctx, bucketName, &RemoveOptions{Names: []string{"rm/1.json", "rm/2.json", "rm/5.json"}, Start: &start, End: &end})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := names(results); got != "rm/2.json!" {
+		t.Fatalf("remove by name and time reported %s", got)
+	}
+
+	results, err = sto.RemoveObjects(ctx, bucketName, &RemoveOptions{Prefix: "rm/", Start: &start, End: &end})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := names(results); got != "rm/3.json!,rm/4.json!" {
+		t.Fatalf("remove by prefix and time reported %s", got)
+	}
+
+	if got := remaining(); got != "rm/1.json,rm/5.json" {
+		t.Fatalf("remove by time left %s", got)
+	}
+
+	//a missing object fails on its own, and the results keep the order of the names
+	results, err = sto.RemoveObjects(ctx, bucketName, &RemoveOptions{Names: []string{"rm/5.json", "rm/missing", "rm/1.json"}, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "rm/5.json!,rm/missing,rm/1.json!"
+	if !conditionalDeletes(sto) {
+		want = "rm/5.json!,rm/missing!,rm/1.json!"
+	}
+
+	if got := names(results); got != want {
+		t.Fatalf("remove by name reported %s, want %s", got, want)
+	}
+
+	if conditionalDeletes(sto) {
+		checkNotFound(t, "remove", results[1].Err)
+	}
+
+	//more objects than the concurrency are all deleted
+	for i := range 40 {
+		if err := sto.WriteBucketFile(ctx, bucketName, fmt.Sprintf("rm/bulk/%02d", i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err = sto.RemoveObjects(ctx, bucketName, &RemoveOptions{Prefix: "rm/bulk/", Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 40 {
+		t.Fatalf("remove by prefix reported %d objects, want 40", len(results))
+	}
+
+	for i, res := range results {
+		if want := fmt.Sprintf("rm/bulk/%02d", i); res.Name != want || !res.Deleted || res.Err != nil {
+			t.Fatalf("remove by prefix reported %+v, want %s deleted", res, want)
+		}
+	}
+
+	if got := remaining(); got != "" {
+		t.Fatalf("remove by prefix left %s", got)
+	}
+}
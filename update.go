@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	//updateBackoff is the longest wait before the first retry of a conflicting update
+	updateBackoff = 10 * time.Millisecond
+	//updateMaxBackoff caps the wait between retries of a conflicting update
+	updateMaxBackoff = time.Second
+	//updateMaxAttempts is the number of read-modify-write cycles made before a conflicting update gives up
+	updateMaxAttempts = 10
+)
+
+// UpdateFunc returns the new data for an object, given its stored data, which is nil if there is no such object. The
+// Update methods write the result back with the object's content type, encoding and metadata, but only if the object
+// is unchanged since it was read, and a missing object is created. Otherwise fn is called again with fresh data after a
+// jittered backoff, until the context is done or the attempts run out, when the error wraps ErrPreconditionFailed.
+// It may be called more than once by a single update, so it should not have side effects
+type UpdateFunc func(data []byte) ([]byte, error)
+
+// updateObject runs a read-modify-write cycle until the write succeeds, as UpdateFunc describes. read returns the stored
+// data and attributes of the object, with nil attributes if there is no such object, and write stores the new data if
+// the object is still as it was read. Either fails with ErrPreconditionFailed if the object changed underneath it, and
+// the cycle gives up after updateMaxAttempts such conflicts
+func updateObject(ctx context.Context, fn UpdateFunc, read func() ([]byte, *ObjectInfo, error), write func([]byte, *ObjectInfo) (*ObjectInfo, error)) (*ObjectInfo, error) {
+	backoff := updateBackoff
+
+	for attempt := 1; ; attempt++ {
+		var info *ObjectInfo
+
+		data, cur, err := read()
+		if err == nil {
+			if data, err = fn(data); err != nil {
+				return nil, err
+			}
+
+			info, err = write(data, cur)
+		}
+
+		if !errors.Is(err, ErrPreconditionFailed) {
+			return info, err
+		}
+
+		if attempt == updateMaxAttempts {
+			return nil, fmt.Errorf("update conflicted %d times: %w", attempt, err)
+		}
+
+		//full jitter spreads out writers which conflicted with each other
+		t := time.NewTimer(rand.N(backoff) + 1)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+
+		backoff = min(backoff*2, updateMaxBackoff)
+	}
+}
+
+// updateOptions returns the options for writing back an object which was read with attributes cur, which keep its
+// content type and metadata, and only allow the write if the object is unchanged
+func updateOptions(cur *ObjectInfo) *WriteOptions {
+	if cur == nil {
+		return &WriteOptions{Conditions: &Conditions{DoesNotExist: true}}
+	}
+
+	return &WriteOptions{
+		ContentType:     cur.ContentType,
+		ContentEncoding: cur.ContentEncoding,
+		Metadata:        cur.Metadata,
+		Conditions:      &Conditions{GenerationMatch: cur.Generation},
+	}
+}